@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// IMA ADPCM with the block layout of WAV format 0x0011:
+//   block header for every channel: s16 predictor (first sample), u8 step index, u8 reserved
+//   then groups of 4 bytes per channel, 8 samples each (low nibble first)
+
+var imaStepTable = [89]int{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17,
+	19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+	50, 55, 60, 66, 73, 80, 88, 97, 107, 118,
+	130, 143, 157, 173, 190, 209, 230, 253, 279, 307,
+	337, 371, 408, 449, 494, 544, 598, 658, 724, 796,
+	876, 963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066,
+	2272, 2499, 2749, 3024, 3327, 3660, 4026, 4428, 4871, 5358,
+	5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487, 12635, 13899,
+	15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767,
+}
+
+var imaIndexTable = [8]int{-1, -1, -1, -1, 2, 4, 6, 8}
+
+type imaState struct {
+	predictor int
+	index     int
+}
+
+func (state *imaState) decode(nibble byte) int16 {
+	step := imaStepTable[state.index]
+	diff := step >> 3
+	if nibble&4 != 0 {
+		diff += step
+	}
+	if nibble&2 != 0 {
+		diff += step >> 1
+	}
+	if nibble&1 != 0 {
+		diff += step >> 2
+	}
+	if nibble&8 != 0 {
+		state.predictor -= diff
+	} else {
+		state.predictor += diff
+	}
+	if state.predictor > 32767 {
+		state.predictor = 32767
+	} else if state.predictor < -32768 {
+		state.predictor = -32768
+	}
+	state.index += imaIndexTable[nibble&7]
+	if state.index < 0 {
+		state.index = 0
+	} else if state.index > 88 {
+		state.index = 88
+	}
+	return int16(state.predictor)
+}
+
+// Nibble is chosen so the decoder result is the closest, state is updated the same way as in decoder
+func (state *imaState) encode(sample int16) byte {
+	step := imaStepTable[state.index]
+	diff := int(sample) - state.predictor
+	var nibble byte
+	if diff < 0 {
+		nibble = 8
+		diff = -diff
+	}
+	if diff >= step {
+		nibble |= 4
+		diff -= step
+	}
+	if diff >= step>>1 {
+		nibble |= 2
+		diff -= step >> 1
+	}
+	if diff >= step>>2 {
+		nibble |= 1
+	}
+	state.decode(nibble)
+	return nibble
+}
+
+// Default block size as in Microsoft encoder
+func ADPCMBlockAlign(channels int, sampleRate uint) int {
+	scale := int(sampleRate / 11000)
+	if scale < 1 {
+		scale = 1
+	}
+	return 256 * channels * scale
+}
+
+func ADPCMSamplesPerBlock(channels int, blockAlign int) int {
+	return (blockAlign-4*channels)*2/channels + 1
+}
+
+// Samples are interleaved 16 bit, last block is shorter, its last group is padded with silence
+func EncodeADPCM(samples []int16, channels int, blockAlign int) []byte {
+	perBlock := ADPCMSamplesPerBlock(channels, blockAlign)
+	count := len(samples) / channels
+	states := make([]imaState, channels)
+	result := make([]byte, 0, (count/perBlock+1)*blockAlign)
+	group := make([]byte, 4)
+	for start := 0; start < count; start += perBlock {
+		end := start + perBlock
+		if end > count {
+			end = count
+		}
+		for ch := range states {
+			first := samples[start*channels+ch]
+			states[ch].predictor = int(first)
+			result = binary.LittleEndian.AppendUint16(result, uint16(first))
+			result = append(result, byte(states[ch].index), 0)
+		}
+		for pos := start + 1; pos < end; pos += 8 {
+			for ch := range states {
+				for i := range group {
+					group[i] = 0
+				}
+				for i := 0; i < 8; i++ {
+					var sample int16
+					if pos+i < end {
+						sample = samples[(pos+i)*channels+ch]
+					}
+					nibble := states[ch].encode(sample)
+					group[i/2] |= nibble << (4 * (i % 2))
+				}
+				result = append(result, group...)
+			}
+		}
+	}
+	return result
+}
+
+func DecodeADPCM(data []byte, channels int, blockAlign int) ([]int16, error) {
+	if channels < 1 || blockAlign <= 4*channels || (blockAlign-4*channels)%(4*channels) != 0 {
+		return nil, fmt.Errorf("wrong ADPCM block size %d for %d channels", blockAlign, channels)
+	}
+	perBlock := ADPCMSamplesPerBlock(channels, blockAlign)
+	result := make([]int16, 0, (len(data)/blockAlign+1)*perBlock*channels)
+	states := make([]imaState, channels)
+	for start := 0; start < len(data); start += blockAlign {
+		end := start + blockAlign
+		if end > len(data) {
+			end = len(data)
+		}
+		block := data[start:end]
+		if len(block) < 4*channels {
+			return result, fmt.Errorf("truncated ADPCM block")
+		}
+		for ch := range states {
+			states[ch].predictor = int(int16(binary.LittleEndian.Uint16(block[ch*4:])))
+			states[ch].index = int(block[ch*4+2])
+			if states[ch].index > 88 {
+				return result, fmt.Errorf("wrong ADPCM step index %d", states[ch].index)
+			}
+			result = append(result, int16(states[ch].predictor))
+		}
+		groups := (len(block) - 4*channels) / (4 * channels)
+		blockStart := len(result)
+		result = append(result, make([]int16, groups*8*channels)...)
+		for g := 0; g < groups; g++ {
+			for ch := range states {
+				offset := 4*channels + (g*channels+ch)*4
+				for i := 0; i < 8; i++ {
+					nibble := (block[offset+i/2] >> (4 * (i % 2))) & 0x0F
+					result[blockStart+(g*8+i)*channels+ch] = states[ch].decode(nibble)
+				}
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNotAIFF       = errors.New("not an AIFF or AIFF-C file")
+	ErrNoCommonChunk = errors.New("no \"COMM\" chunk")
+	ErrNoSoundChunk  = errors.New("no \"SSND\" chunk")
+)
+
+// 80 bit IEEE 754 extended precision number
+func readExtended(data []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(data) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(data[2:])
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if data[0]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
+
+func parseAIFFCommon(data []byte, compressed bool) (PCMFormat, int, error) {
+	if len(data) < 18 || (compressed && len(data) < 22) {
+		return PCMFormat{}, 0, &ChunkError{"AIFF", "COMM", ErrTruncated}
+	}
+	channels := int(binary.BigEndian.Uint16(data[0:]))
+	bits := int(binary.BigEndian.Uint16(data[6:]))
+	rate := readExtended(data[8:18])
+	if channels == 0 || bits == 0 || rate < 1 {
+		return PCMFormat{}, 0, &ChunkError{"AIFF", "COMM", errors.New("zero channels, sample rate or sample size")}
+	}
+
+	format := PCMFormat{BigEndian: true}
+	if compressed {
+		// Compression types of uncompressed samples
+		compression := string(data[18:22])
+		switch compression {
+		case "NONE", "twos":
+		case "sowt":
+			format.BigEndian = false
+		case "raw ":
+			format.Unsigned = true
+		case "in24":
+			bits = 24
+		case "in32":
+			bits = 32
+		case "fl32", "FL32":
+			format.Float = true
+			bits = 32
+		case "fl64", "FL64":
+			format.Float = true
+			bits = 64
+		default:
+			return PCMFormat{}, 0, &FormatError{"AIFF", fmt.Sprintf("compression \"%s\"", strings.TrimSpace(compression))}
+		}
+	}
+	format.Channels = channels
+	format.SampleRate = uint(math.Round(rate))
+	format.SampleSize = (bits + 7) / 8
+	return format, bits, nil
+}
+
+// Reads AIFF and uncompressed AIFF-C, samples are left-justified in their containers
+func LoadAIFF(filename string) (*AudioBuffer, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var header [12]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil || string(header[0:4]) != "FORM" ||
+		(string(header[8:12]) != "AIFF" && string(header[8:12]) != "AIFC") {
+		return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, ErrNotAIFF)
+	}
+	compressed := string(header[8:12]) == "AIFC"
+
+	var format PCMFormat
+	bits := 0
+	var sound []byte
+	for format.Channels == 0 || sound == nil {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(reader, chunkHeader[:]); err != nil {
+			if err == io.EOF && format.Channels == 0 {
+				err = ErrNoCommonChunk
+			} else if err == io.EOF {
+				err = ErrNoSoundChunk
+			} else {
+				err = ErrTruncated
+			}
+			return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, err)
+		}
+		name := string(chunkHeader[:4])
+		size := binary.BigEndian.Uint32(chunkHeader[4:])
+		data, err := io.ReadAll(io.LimitReader(reader, int64(size)))
+		// Samples of interrupted recording are used as is
+		if err != nil || (len(data) < int(size) && name != "SSND") {
+			return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, &ChunkError{"AIFF", name, ErrTruncated})
+		}
+		if size&1 == 1 {
+			reader.ReadByte()
+		}
+		switch name {
+		case "COMM":
+			if format, bits, err = parseAIFFCommon(data, compressed); err != nil {
+				return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, err)
+			}
+		case "SSND":
+			if len(data) < 8 {
+				return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, &ChunkError{"AIFF", name, ErrTruncated})
+			}
+			offset := int(binary.BigEndian.Uint32(data))
+			if 8+offset > len(data) {
+				return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, &ChunkError{"AIFF", name, ErrTruncated})
+			}
+			sound = data[8+offset:]
+		}
+	}
+
+	buffer, err := DecodePCM(sound, format)
+	if err != nil {
+		return nil, fmt.Errorf("can't load aiff \"%s\": %w", filename, err)
+	}
+	buffer.Bits = bits
+	return buffer, nil
+}
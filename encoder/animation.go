@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+)
+
+// Animation fully decoded into composited frames with their durations,
+// played back at a constant frame rate by repeating or dropping frames
+type Animation struct {
+	width     int
+	height    int
+	frames    [][]IntColor
+	delays    []float64 // seconds
+	frameRate float64
+	count     int
+	index     int
+	current   int
+	frameEnd  float64
+}
+
+func NewAnimation(width int, height int, frameRate float64) *Animation {
+	return &Animation{
+		width:     width,
+		height:    height,
+		frameRate: frameRate,
+	}
+}
+
+func (anim *Animation) AddFrame(img *image.RGBA, delay float64) {
+	result := make([]IntColor, 0, anim.width*anim.height)
+	for y := 0; y < anim.height; y++ {
+		for x := 0; x < anim.width; x++ {
+			// Transparent areas are shown over black
+			offset := img.PixOffset(x, y)
+			result = append(result, IntColor{int(img.Pix[offset]), int(img.Pix[offset+1]), int(img.Pix[offset+2])})
+		}
+	}
+	anim.frames = append(anim.frames, result)
+	anim.delays = append(anim.delays, delay)
+}
+
+// Must be called after all frames are added
+func (anim *Animation) start() {
+	duration := 0.0
+	for _, delay := range anim.delays {
+		duration += delay
+	}
+	anim.count = int(duration*anim.frameRate + 0.5)
+	if anim.count < 1 {
+		anim.count = 1
+	}
+	anim.frameEnd = anim.delays[0]
+}
+
+func (anim *Animation) Size() (int, int) {
+	return anim.width, anim.height
+}
+
+func (anim *Animation) FrameRate() float64 {
+	return anim.frameRate
+}
+
+func (anim *Animation) FrameCount() int {
+	return anim.count
+}
+
+func (anim *Animation) Next() (Frame, error) {
+	if anim.index >= anim.count {
+		return Frame{}, io.EOF
+	}
+	// Source frame that is shown at the start of the output frame
+	time := float64(anim.index) / anim.frameRate
+	for time >= anim.frameEnd-1e-9 && anim.current < len(anim.frames)-1 {
+		anim.current++
+		anim.frameEnd += anim.delays[anim.current]
+	}
+	anim.index++
+	return Frame{anim.frames[anim.current], anim.width, anim.height}, nil
+}
+
+func (anim *Animation) Close() error {
+	return nil
+}
+
+//region GIF
+
+// Browsers show frames with delay of 0 or 1 (1/100 s) for 0.1 s
+const gifMinDelay = 2
+const gifDefaultDelay = 10
+
+func LoadGIF(filename string, frameRate float64) (*Animation, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't load gif \"%s\": %w", filename, err)
+	}
+
+	width := data.Config.Width
+	height := data.Config.Height
+	if width == 0 || height == 0 {
+		bounds := data.Image[0].Bounds()
+		width, height = bounds.Max.X, bounds.Max.Y
+	}
+	result := NewAnimation(width, height, frameRate)
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	var previous *image.RGBA
+
+	for i, frame := range data.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(data.Disposal) {
+			disposal = data.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		delay := gifDefaultDelay
+		if i < len(data.Delay) && data.Delay[i] >= gifMinDelay {
+			delay = data.Delay[i]
+		}
+		result.AddFrame(canvas, float64(delay)/100)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.NewUniform(color.Transparent), image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	result.start()
+	return result, nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	result := image.NewRGBA(img.Bounds())
+	copy(result.Pix, img.Pix)
+	return result
+}
+
+//endregion
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+)
+
+// APNG decoder: every frame is rebuilt into a standalone PNG
+// (IHDR with frame size, ancillary chunks of the file and frame data as IDAT) and decoded by image/png
+
+const (
+	apngDisposeNone       = 0
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendSource       = 0
+	apngBlendOver         = 1
+)
+
+type pngChunk struct {
+	name string
+	data []byte
+}
+
+type apngFrame struct {
+	width     int
+	height    int
+	x         int
+	y         int
+	delay     float64
+	dispose   byte
+	blend     byte
+	idat      [][]byte
+	isDefault bool
+}
+
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("wrong png signature")
+	}
+	result := make([]pngChunk, 0)
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("truncated chunk header")
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		name := string(data[pos+4 : pos+8])
+		if size < 0 || pos+12+size > len(data) {
+			return nil, fmt.Errorf("truncated chunk \"%s\"", name)
+		}
+		result = append(result, pngChunk{name, data[pos+8 : pos+8+size]})
+		pos += 12 + size
+		if name == "IEND" {
+			break
+		}
+	}
+	return result, nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, name string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.WriteString(name)
+	buf.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(name))
+	crc.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// Checks for acTL chunk before image data, only chunk headers are read
+func IsAPNG(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(file, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return false
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			return false
+		}
+		switch string(header[4:]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		// Chunk data and CRC
+		if _, err := file.Seek(int64(binary.BigEndian.Uint32(header))+4, io.SeekCurrent); err != nil {
+			return false
+		}
+	}
+}
+
+func parseAPNGFrames(chunks []pngChunk) (ihdr []byte, ancillary []pngChunk, frames []*apngFrame, err error) {
+	var current *apngFrame
+	seenIDAT := false
+	for _, chunk := range chunks {
+		switch chunk.name {
+		case "IHDR":
+			if len(chunk.data) != 13 {
+				return nil, nil, nil, fmt.Errorf("wrong IHDR size")
+			}
+			ihdr = chunk.data
+		case "acTL", "IEND":
+		case "fcTL":
+			if len(chunk.data) != 26 {
+				return nil, nil, nil, fmt.Errorf("wrong fcTL size")
+			}
+			d := chunk.data
+			delayNum := binary.BigEndian.Uint16(d[20:])
+			delayDen := binary.BigEndian.Uint16(d[22:])
+			if delayDen == 0 {
+				delayDen = 100
+			}
+			current = &apngFrame{
+				width:     int(binary.BigEndian.Uint32(d[4:])),
+				height:    int(binary.BigEndian.Uint32(d[8:])),
+				x:         int(binary.BigEndian.Uint32(d[12:])),
+				y:         int(binary.BigEndian.Uint32(d[16:])),
+				delay:     float64(delayNum) / float64(delayDen),
+				dispose:   d[24],
+				blend:     d[25],
+				isDefault: !seenIDAT,
+			}
+			frames = append(frames, current)
+		case "IDAT":
+			seenIDAT = true
+			// Default image is not a part of animation without fcTL before it
+			if current != nil && current.isDefault {
+				current.idat = append(current.idat, chunk.data)
+			}
+		case "fdAT":
+			if current == nil || len(chunk.data) < 4 {
+				return nil, nil, nil, fmt.Errorf("fdAT without fcTL")
+			}
+			current.idat = append(current.idat, chunk.data[4:])
+		default:
+			if !seenIDAT {
+				ancillary = append(ancillary, chunk)
+			}
+		}
+	}
+	if ihdr == nil {
+		return nil, nil, nil, fmt.Errorf("no IHDR chunk")
+	}
+	if len(frames) == 0 {
+		return nil, nil, nil, fmt.Errorf("no animation frames")
+	}
+	return ihdr, ancillary, frames, nil
+}
+
+func (frame *apngFrame) decode(ihdr []byte, ancillary []pngChunk) (image.Image, error) {
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	header := make([]byte, len(ihdr))
+	copy(header, ihdr)
+	binary.BigEndian.PutUint32(header[0:], uint32(frame.width))
+	binary.BigEndian.PutUint32(header[4:], uint32(frame.height))
+	writePNGChunk(&buf, "IHDR", header)
+	for _, chunk := range ancillary {
+		writePNGChunk(&buf, chunk.name, chunk.data)
+	}
+	for _, data := range frame.idat {
+		writePNGChunk(&buf, "IDAT", data)
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	return png.Decode(&buf)
+}
+
+func LoadAPNG(filename string, frameRate float64) (*Animation, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't load apng \"%s\": %w", filename, err)
+	}
+	ihdr, ancillary, frames, err := parseAPNGFrames(chunks)
+	if err != nil {
+		return nil, fmt.Errorf("can't load apng \"%s\": %w", filename, err)
+	}
+
+	width := int(binary.BigEndian.Uint32(ihdr[0:]))
+	height := int(binary.BigEndian.Uint32(ihdr[4:]))
+	result := NewAnimation(width, height, frameRate)
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for i, frame := range frames {
+		img, err := frame.decode(ihdr, ancillary)
+		if err != nil {
+			return nil, fmt.Errorf("can't load apng \"%s\" frame %d: %w", filename, i, err)
+		}
+		rect := image.Rect(frame.x, frame.y, frame.x+frame.width, frame.y+frame.height)
+
+		dispose := frame.dispose
+		if i == 0 && dispose == apngDisposePrevious {
+			dispose = apngDisposeBackground
+		}
+		var previous *image.RGBA
+		if dispose == apngDisposePrevious {
+			previous = cloneRGBA(canvas)
+		}
+		op := draw.Over
+		if frame.blend == apngBlendSource {
+			op = draw.Src
+		}
+		draw.Draw(canvas, rect, img, img.Bounds().Min, op)
+		result.AddFrame(canvas, frame.delay)
+
+		switch dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, rect, image.NewUniform(color.Transparent), image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = previous
+		}
+	}
+	result.start()
+	return result, nil
+}
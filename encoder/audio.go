@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Returned by all file readers
+var ErrTruncated = errors.New("unexpected end of file")
+
+// Error in a specific chunk of a RIFF or IFF file, e.g. Format "AIFF", ID "COMM"
+type ChunkError struct {
+	Format string
+	ID     string
+	Err    error
+}
+
+func (err *ChunkError) Error() string {
+	return fmt.Sprintf("%s chunk \"%s\": %s", err.Format, err.ID, err.Err)
+}
+
+func (err *ChunkError) Unwrap() error {
+	return err.Err
+}
+
+// Format that can be read but is not supported, e.g. Format "WAV"
+type FormatError struct {
+	Format string
+	Reason string
+}
+
+func (err *FormatError) Error() string {
+	return fmt.Sprintf("unsupported %s format: %s", err.Format, err.Reason)
+}
+
+// Layout of interleaved PCM samples
+type PCMFormat struct {
+	Channels   int
+	SampleRate uint
+	SampleSize int // bytes per sample of one channel
+	Float      bool
+	BigEndian  bool
+	Unsigned   bool // 8 bit WAV samples
+}
+
+// Decoded audio, samples of every channel are in range -1..1
+type AudioBuffer struct {
+	SampleRate uint
+	Bits       int // precision of the source
+	Channels   [][]float64
+}
+
+// Output audio format, zero values keep the input parameters when RVF supports them
+type AudioSettings struct {
+	SampleRate uint
+	Channels   int
+	Bits       int
+	Codec      string // "pcm" or "adpcm"
+}
+
+// Audio codec IDs, stored in the quality byte of the header
+const (
+	AudioCodecPCM8  uint8 = 0
+	AudioCodecPCM16 uint8 = 1
+	AudioCodecADPCM uint8 = 2
+)
+
+var audioCodecNames = map[uint8]string{
+	AudioCodecPCM8:  "pcm8",
+	AudioCodecPCM16: "pcm16",
+	AudioCodecADPCM: "adpcm",
+}
+
+const (
+	minAudioRate = 8000
+	maxAudioRate = 192000
+)
+
+func (settings AudioSettings) Validate() error {
+	if settings.SampleRate != 0 && (settings.SampleRate < minAudioRate || settings.SampleRate > maxAudioRate) {
+		return fmt.Errorf("wrong audio sample rate %d (must be %d..%d)", settings.SampleRate, minAudioRate, maxAudioRate)
+	}
+	if settings.Channels != 0 && settings.Channels != 1 && settings.Channels != 2 {
+		return fmt.Errorf("wrong number of audio channels %d (must be 1 or 2)", settings.Channels)
+	}
+	if settings.Bits != 0 && settings.Bits != 8 && settings.Bits != 16 {
+		return fmt.Errorf("wrong audio bit depth %d (must be 8 or 16)", settings.Bits)
+	}
+	switch settings.Codec {
+	case "", "pcm":
+	case "adpcm":
+		if settings.Bits == 8 {
+			return fmt.Errorf("ADPCM audio is encoded from 16 bit samples")
+		}
+	default:
+		return fmt.Errorf("unknown audio codec \"%s\" (must be pcm or adpcm)", settings.Codec)
+	}
+	return nil
+}
+
+func (buffer *AudioBuffer) Len() int {
+	if len(buffer.Channels) == 0 {
+		return 0
+	}
+	return len(buffer.Channels[0])
+}
+
+func (buffer *AudioBuffer) Duration() float64 {
+	return float64(buffer.Len()) / float64(buffer.SampleRate)
+}
+
+func DecodePCM(data []byte, format PCMFormat) (*AudioBuffer, error) {
+	if format.Channels < 1 || format.SampleSize < 1 || format.SampleSize > 8 {
+		return nil, fmt.Errorf("wrong PCM format: %d channels, %d bytes per sample", format.Channels, format.SampleSize)
+	}
+	if format.Float && format.SampleSize != 4 && format.SampleSize != 8 {
+		return nil, fmt.Errorf("wrong PCM format: %d bytes per float sample", format.SampleSize)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if format.BigEndian {
+		order = binary.BigEndian
+	}
+	blockSize := format.Channels * format.SampleSize
+	count := len(data) / blockSize
+	result := &AudioBuffer{
+		SampleRate: format.SampleRate,
+		Bits:       format.SampleSize * 8,
+		Channels:   make([][]float64, format.Channels),
+	}
+	for ch := range result.Channels {
+		result.Channels[ch] = make([]float64, count)
+	}
+	// Integer samples are read into the top bits of uint64, so any container size scales the same way
+	scale := 1.0 / float64(uint64(1)<<63)
+	sample := make([]byte, 8)
+	for i := 0; i < count; i++ {
+		for ch := 0; ch < format.Channels; ch++ {
+			raw := data[i*blockSize+ch*format.SampleSize : i*blockSize+(ch+1)*format.SampleSize]
+			var value float64
+			switch {
+			case format.Float && format.SampleSize == 4:
+				value = float64(math.Float32frombits(order.Uint32(raw)))
+			case format.Float:
+				value = math.Float64frombits(order.Uint64(raw))
+			default:
+				for j := range sample {
+					sample[j] = 0
+				}
+				if format.BigEndian {
+					copy(sample, raw)
+				} else {
+					for j, b := range raw {
+						sample[format.SampleSize-1-j] = b
+					}
+				}
+				bits := binary.BigEndian.Uint64(sample)
+				if format.Unsigned {
+					bits ^= 1 << 63
+				}
+				value = float64(int64(bits)) * scale
+			}
+			result.Channels[ch][i] = math.Max(-1, math.Min(1, value))
+		}
+	}
+	return result, nil
+}
+
+//region DOWNMIX
+
+// WAV channel order: FL, FR, FC, LFE, BL, BR, SL, SR. Centre and surround channels go to both sides at -3 dB, LFE is dropped.
+var downmixLeft = []float64{1, 0, 0.7071, 0, 0.7071, 0, 0.7071, 0}
+var downmixRight = []float64{0, 1, 0.7071, 0, 0, 0.7071, 0, 0.7071}
+var downmixMono = []float64{1, 1, 1.4142, 0, 0.7071, 0.7071, 0.7071, 0.7071}
+
+func (buffer *AudioBuffer) mix(weights []float64) []float64 {
+	result := make([]float64, buffer.Len())
+	total := 0.0
+	for ch, samples := range buffer.Channels {
+		if ch >= len(weights) || weights[ch] == 0 {
+			continue
+		}
+		weight := weights[ch]
+		total += weight
+		for i, sample := range samples {
+			result[i] += sample * weight
+		}
+	}
+	if total > 0 {
+		for i := range result {
+			result[i] /= total
+		}
+	}
+	return result
+}
+
+func (buffer *AudioBuffer) Remix(channels int) *AudioBuffer {
+	if len(buffer.Channels) == channels {
+		return buffer
+	}
+	result := &AudioBuffer{SampleRate: buffer.SampleRate, Bits: buffer.Bits}
+	switch {
+	case channels == 1:
+		result.Channels = [][]float64{buffer.mix(downmixMono)}
+	case len(buffer.Channels) == 1:
+		result.Channels = [][]float64{buffer.Channels[0], buffer.Channels[0]}
+	default:
+		result.Channels = [][]float64{buffer.mix(downmixLeft), buffer.mix(downmixRight)}
+	}
+	return result
+}
+
+//endregion
+
+//region RESAMPLE
+
+// Windowed sinc (Kaiser window) with this many zero crossings on each side
+const resampleZeroCrossings = 16
+const resampleTableStep = 256
+const resampleKaiserBeta = 8.0
+
+func besselI0(x float64) float64 {
+	sum := 1.0
+	term := 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func resampleTable() []float64 {
+	size := resampleZeroCrossings*resampleTableStep + 1
+	table := make([]float64, size+1)
+	norm := besselI0(resampleKaiserBeta)
+	for i := 0; i < size; i++ {
+		x := float64(i) / resampleTableStep
+		ratio := x / resampleZeroCrossings
+		window := besselI0(resampleKaiserBeta*math.Sqrt(1-ratio*ratio)) / norm
+		table[i] = sinc(x) * window
+	}
+	return table
+}
+
+func (buffer *AudioBuffer) Resample(rate uint) *AudioBuffer {
+	if buffer.SampleRate == rate || buffer.Len() == 0 {
+		return buffer
+	}
+	table := resampleTable()
+	step := float64(buffer.SampleRate) / float64(rate)
+	// Cutoff is lowered to the output Nyquist frequency when downsampling
+	cutoff := math.Min(1, 1/step)
+	radius := float64(resampleZeroCrossings) / cutoff
+	count := int(float64(buffer.Len()) / step)
+
+	result := &AudioBuffer{
+		SampleRate: rate,
+		Bits:       buffer.Bits,
+		Channels:   make([][]float64, len(buffer.Channels)),
+	}
+	for ch, samples := range buffer.Channels {
+		output := make([]float64, count)
+		for i := range output {
+			center := float64(i) * step
+			first := int(math.Ceil(center - radius))
+			last := int(math.Floor(center + radius))
+			acc := 0.0
+			for j := first; j <= last; j++ {
+				if j < 0 || j >= len(samples) {
+					continue
+				}
+				pos := math.Abs(float64(j)-center) * cutoff * resampleTableStep
+				index := int(pos)
+				frac := pos - float64(index)
+				weight := table[index] + (table[index+1]-table[index])*frac
+				acc += samples[j] * weight
+			}
+			output[i] = acc * cutoff
+		}
+		result.Channels[ch] = output
+	}
+	return result
+}
+
+//endregion
+
+// 8 bit samples may get triangular (TPDF) dither of 1 LSB
+func (buffer *AudioBuffer) Quantize(bits int, dither bool) []byte {
+	channels := len(buffer.Channels)
+	count := buffer.Len()
+	if bits == 16 {
+		result := make([]byte, count*channels*2)
+		for i := 0; i < count; i++ {
+			for ch, samples := range buffer.Channels {
+				value := int16(math.Max(-32768, math.Min(32767, math.Round(samples[i]*32768))))
+				binary.LittleEndian.PutUint16(result[(i*channels+ch)*2:], uint16(value))
+			}
+		}
+		return result
+	}
+	rnd := rand.New(rand.NewSource(1))
+	result := make([]byte, count*channels)
+	for i := 0; i < count; i++ {
+		for ch, samples := range buffer.Channels {
+			value := samples[i] * 128
+			if dither {
+				value += rnd.Float64() - rnd.Float64()
+			}
+			value = math.Round(value)
+			result[i*channels+ch] = byte(int(math.Max(-128, math.Min(127, value))) + 128)
+		}
+	}
+	return result
+}
+
+// Converts audio to the format stored in RVF
+func ConvertAudio(buffer *AudioBuffer, settings AudioSettings) *WAVfile {
+	rate := settings.SampleRate
+	if rate == 0 {
+		rate = buffer.SampleRate
+		if rate < minAudioRate {
+			rate = minAudioRate
+		}
+		if rate > maxAudioRate {
+			rate = maxAudioRate
+		}
+	}
+	channels := settings.Channels
+	if channels == 0 {
+		channels = len(buffer.Channels)
+		if channels > 2 {
+			channels = 2
+		}
+	}
+	adpcm := settings.Codec == "adpcm"
+	bits := settings.Bits
+	if adpcm {
+		bits = 16
+	} else if bits == 0 {
+		bits = 16
+		if buffer.Bits == 8 {
+			bits = 8
+		}
+	}
+	converted := buffer.Remix(channels).Resample(rate)
+	// Unchanged 8 bit samples are restored exactly
+	dither := bits == 8 && (buffer.Bits != 8 || converted != buffer)
+	result := &WAVfile{
+		Cannels:    channels,
+		SampleRate: rate,
+		Codec:      AudioCodecPCM16,
+		Data:       converted.Quantize(bits, dither),
+	}
+	if bits == 8 {
+		result.Codec = AudioCodecPCM8
+	}
+	if adpcm {
+		samples := make([]int16, len(result.Data)/2)
+		for i := range samples {
+			samples[i] = int16(binary.LittleEndian.Uint16(result.Data[i*2:]))
+		}
+		result.Codec = AudioCodecADPCM
+		result.BlockAlign = ADPCMBlockAlign(channels, rate)
+		result.Data = EncodeADPCM(samples, channels, result.BlockAlign)
+	}
+	return result
+}
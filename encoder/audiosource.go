@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Parses raw PCM parameters "rate,channels,bits".
+// Samples are signed little endian integers, bits may have suffixes:
+// "u" for unsigned, "be" for big endian, "f" for float (32 or 64 bits), e.g. "8u" or "16be".
+func ParseRawPCMFormat(spec string) (PCMFormat, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 3 {
+		return PCMFormat{}, fmt.Errorf("wrong raw audio format \"%s\" (must be rate,channels,bits)", spec)
+	}
+	rate, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil || rate == 0 {
+		return PCMFormat{}, fmt.Errorf("wrong raw audio sample rate \"%s\"", parts[0])
+	}
+	channels, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || channels < 1 || channels > 8 {
+		return PCMFormat{}, fmt.Errorf("wrong raw audio channels \"%s\" (must be 1..8)", parts[1])
+	}
+
+	format := PCMFormat{Channels: channels, SampleRate: uint(rate)}
+	bitsSpec := strings.ToLower(strings.TrimSpace(parts[2]))
+	for {
+		if rest, ok := strings.CutSuffix(bitsSpec, "be"); ok {
+			format.BigEndian = true
+			bitsSpec = rest
+		} else if rest, ok := strings.CutSuffix(bitsSpec, "u"); ok {
+			format.Unsigned = true
+			bitsSpec = rest
+		} else if rest, ok := strings.CutSuffix(bitsSpec, "f"); ok {
+			format.Float = true
+			bitsSpec = rest
+		} else {
+			break
+		}
+	}
+	bits, err := strconv.Atoi(bitsSpec)
+	if err != nil || bits < 8 || bits > 64 || bits%8 != 0 || (format.Float && bits != 32 && bits != 64) || (format.Float && format.Unsigned) {
+		return PCMFormat{}, fmt.Errorf("wrong raw audio bits \"%s\"", parts[2])
+	}
+	format.SampleSize = bits / 8
+	return format, nil
+}
+
+func LoadRawPCM(filename string, format PCMFormat) (*AudioBuffer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePCM(data, format)
+}
+
+// Loads audio file of any supported format, raw PCM is used when rawFormat is set.
+// Other formats are recognized by their signatures.
+func OpenAudio(filename string, rawFormat string) (*AudioBuffer, error) {
+	if rawFormat != "" {
+		format, err := ParseRawPCMFormat(rawFormat)
+		if err != nil {
+			return nil, err
+		}
+		return LoadRawPCM(filename, format)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var signature [4]byte
+	_, err = file.Read(signature[:])
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("can't load audio \"%s\": %w", filename, ErrTruncated)
+	}
+	switch string(signature[:]) {
+	case "RIFF":
+		return LoadWAV(filename)
+	case "FORM":
+		return LoadAIFF(filename)
+	}
+	return nil, fmt.Errorf("unknown audio format of \"%s\" (WAV and AIFF are supported, use --audio-raw for raw PCM)", filename)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+const blueNoiseSigma = 1.5
+
+// Void-and-cluster (Ulichney) threshold matrix generator
+type voidAndCluster struct {
+	width  int
+	height int
+	kernel []float64
+	binary []bool
+	energy []float64
+}
+
+func newVoidAndCluster(width int, height int) *voidAndCluster {
+	vc := &voidAndCluster{
+		width:  width,
+		height: height,
+		kernel: make([]float64, width*height),
+		binary: make([]bool, width*height),
+		energy: make([]float64, width*height),
+	}
+	// Gaussian of toroidal distance, indexed by offset
+	for dy := 0; dy < height; dy++ {
+		for dx := 0; dx < width; dx++ {
+			x := math.Min(float64(dx), float64(width-dx))
+			y := math.Min(float64(dy), float64(height-dy))
+			vc.kernel[dx+dy*width] = math.Exp(-(x*x + y*y) / (2 * blueNoiseSigma * blueNoiseSigma))
+		}
+	}
+	return vc
+}
+
+func (vc *voidAndCluster) set(index int, value bool) {
+	if vc.binary[index] == value {
+		return
+	}
+	vc.binary[index] = value
+	sign := 1.0
+	if !value {
+		sign = -1.0
+	}
+	px := index % vc.width
+	py := index / vc.width
+	for y := 0; y < vc.height; y++ {
+		dy := (y - py + vc.height) % vc.height
+		for x := 0; x < vc.width; x++ {
+			dx := (x - px + vc.width) % vc.width
+			vc.energy[x+y*vc.width] += sign * vc.kernel[dx+dy*vc.width]
+		}
+	}
+}
+
+func (vc *voidAndCluster) tightestCluster() int {
+	result := -1
+	best := -math.MaxFloat64
+	for i, isSet := range vc.binary {
+		if isSet && vc.energy[i] > best {
+			best = vc.energy[i]
+			result = i
+		}
+	}
+	return result
+}
+
+func (vc *voidAndCluster) largestVoid() int {
+	result := -1
+	best := math.MaxFloat64
+	for i, isSet := range vc.binary {
+		if !isSet && vc.energy[i] < best {
+			best = vc.energy[i]
+			result = i
+		}
+	}
+	return result
+}
+
+func (vc *voidAndCluster) state() ([]bool, []float64) {
+	binary := make([]bool, len(vc.binary))
+	energy := make([]float64, len(vc.energy))
+	copy(binary, vc.binary)
+	copy(energy, vc.energy)
+	return binary, energy
+}
+
+func (vc *voidAndCluster) restore(binary []bool, energy []float64) {
+	copy(vc.binary, binary)
+	copy(vc.energy, energy)
+}
+
+func (vc *voidAndCluster) ranks(seed int64) []int {
+	size := vc.width * vc.height
+	rnd := rand.New(rand.NewSource(seed))
+
+	// Initial binary pattern: random points, then spread evenly by moving tightest clusters into largest voids
+	ones := size / 10
+	if ones < 1 {
+		ones = 1
+	}
+	for _, i := range rnd.Perm(size)[:ones] {
+		vc.set(i, true)
+	}
+	for {
+		cluster := vc.tightestCluster()
+		vc.set(cluster, false)
+		void := vc.largestVoid()
+		if void == cluster {
+			vc.set(cluster, true)
+			break
+		}
+		vc.set(void, true)
+	}
+	protoBinary, protoEnergy := vc.state()
+
+	result := make([]int, size)
+
+	// Phase 1: ranks of initial points, removing tightest clusters first
+	for rank := ones - 1; rank >= 0; rank-- {
+		cluster := vc.tightestCluster()
+		vc.set(cluster, false)
+		result[cluster] = rank
+	}
+
+	// Phases 2 and 3: filling largest voids.
+	// With linear energy tightest cluster of zeros is the same pixel as largest void of ones.
+	vc.restore(protoBinary, protoEnergy)
+	for rank := ones; rank < size; rank++ {
+		void := vc.largestVoid()
+		vc.set(void, true)
+		result[void] = rank
+	}
+	return result
+}
+
+// Ranks are scaled down to the pattern order (number of dithering levels), order must be 1..maxPatternOrder
+func GenerateBlueNoise(width int, height int, order int, seed int64) (*Pattern, error) {
+	if order < 1 || order > maxPatternOrder {
+		return nil, fmt.Errorf("wrong pattern order %d (must be from 1 to %d)", order, maxPatternOrder)
+	}
+	result := NewPattern(width, height, order)
+	size := width * height
+	for i, rank := range newVoidAndCluster(width, height).ranks(seed) {
+		result.Data[i] = rank * result.Order / size
+	}
+	return result, nil
+}
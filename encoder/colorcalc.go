@@ -26,6 +26,10 @@ type ColorCalc struct {
 
 	colors    int
 	poinCount uint64
+	size      int // requested palette size, may be larger than colors
+
+	locked     LockedColors
+	freeColors int
 
 	totalDistance float64
 	pointsChanged uint64
@@ -46,21 +50,40 @@ func swapPoints(left, right *ColorPoint) {
 	*left, *right = *right, *left
 }
 
-func NewColorCalc(colors int, steps int, attempts int) *ColorCalc {
+func NewColorCalc(colors int, steps int, attempts int, locked LockedColors) (*ColorCalc, error) {
 	if colors > 256 {
 		colors = 256
 	}
 	if colors < 1 {
 		colors = 1
 	}
-	return &ColorCalc{colors: colors, maxSteps: steps, maxAttempt: attempts}
+	if len(locked) > colors {
+		return nil, fmt.Errorf("too many locked colors (%d, palette size is %d)", len(locked), colors)
+	}
+	if locked.MaxIndex() >= colors {
+		return nil, fmt.Errorf("locked color index %d is out of palette (%d colors)", locked.MaxIndex(), colors)
+	}
+	return &ColorCalc{
+		colors:     colors,
+		size:       colors,
+		freeColors: colors - len(locked),
+		locked:     locked,
+		maxSteps:   steps,
+		maxAttempt: attempts}, nil
 }
 
-func (cc *ColorCalc) Input(images []string) {
-	var cube [256][256][256]uint64
+func (cc *ColorCalc) Input(images []string, sampling ColorSampling) {
+	if sampling.FrameStep < 1 {
+		sampling.FrameStep = 1
+	}
+	if sampling.PixelStep < 1 {
+		sampling.PixelStep = 1
+	}
+	hist := NewColorHistogram(sampling.MaxColors)
 	fmt.Println("Loading images...")
 
-	bar := progressbar.NewOptions(len(images),
+	frames := (len(images) + sampling.FrameStep - 1) / sampling.FrameStep
+	bar := progressbar.NewOptions(frames,
 		progressbar.OptionFullWidth(),
 		progressbar.OptionShowCount(),
 		progressbar.OptionShowIts(),
@@ -69,53 +92,37 @@ func (cc *ColorCalc) Input(images []string) {
 
 	bar.Set(0)
 
-	for i, imgName := range images {
-		img, _, _, err := ImageLoad(imgName)
+	for i := 0; i < frames; i++ {
+		img, _, _, err := ImageLoad(images[i*sampling.FrameStep])
 		if err != nil {
 			panic(err)
 		}
-		for _, data := range img {
-			cube[data.R][data.G][data.B]++
+		// Shifting the start on every frame to avoid sampling the same pixels
+		for p := i % sampling.PixelStep; p < len(img); p += sampling.PixelStep {
+			hist.Add(img[p])
 		}
 		bar.Set(i + 1)
 	}
 
 	bar.Finish()
 
-	colors_total := uint64(0)
-	for r := 0; r < 256; r++ {
-		for g := 0; g < 256; g++ {
-			for b := 0; b < 256; b++ {
-				if cube[r][g][b] > 0 {
-					colors_total++
-				}
-			}
-		}
-	}
+	colors_total := uint64(hist.Len())
 
 	fmt.Printf("\n\nTotal number of colors: %d\n", colors_total)
-	if uint64(cc.colors) > colors_total {
-		cc.colors = int(colors_total)
+	if hist.Bits() < 8 {
+		fmt.Printf("Histogram precision reduced to %d bits per channel\n", hist.Bits())
+	}
+	// Fewer centroids than free slots, unused slots are filled in calcPalette
+	if uint64(cc.freeColors) > colors_total {
+		cc.freeColors = int(colors_total)
+		cc.colors = cc.freeColors + len(cc.locked)
 	}
 	cc.poinCount = colors_total
 	if colors_total == 0 {
 		panic(errors.New("wrong input"))
 	}
 
-	cc.points = make([]ColorPoint, 0, colors_total)
-	for r := 0; r < 256; r++ {
-		for g := 0; g < 256; g++ {
-			for b := 0; b < 256; b++ {
-				if cube[r][g][b] > 0 {
-					cc.points = append(cc.points, ColorPoint{
-						color:    FloatColor{float64(r) / 255, float64(g) / 255, float64(b) / 255},
-						segment:  0,
-						count:    cube[r][g][b],
-						distance: math.MaxFloat64})
-				}
-			}
-		}
-	}
+	cc.points = hist.Points()
 
 	cc.workers = runtime.NumCPU()
 	if cc.workers > 1 {
@@ -129,7 +136,11 @@ func (cc *ColorCalc) Input(images []string) {
 }
 
 func (point *ColorPoint) pointDistance(center *ColorPoint) float64 {
-	dist := point.color.Distance(center.color)
+	return point.colorDistance(center.color)
+}
+
+func (point *ColorPoint) colorDistance(center FloatColor) float64 {
+	dist := point.color.Distance(center)
 	if dist < point.distance {
 		point.distance = dist
 		return dist
@@ -137,19 +148,36 @@ func (point *ColorPoint) pointDistance(center *ColorPoint) float64 {
 	return point.distance
 }
 
+// Locked colors are fixed centroids placed after the free ones, k-means++ seeding takes them into account
 func (cc *ColorCalc) initCentroids() {
+	for i := range cc.points {
+		cc.points[i].distance = math.MaxFloat64
+	}
 	centInd := 0
-	swapPoints(&cc.points[0], &cc.points[rand.Uint64()%cc.poinCount])
-	for centInd < cc.colors-1 {
+	if len(cc.locked) == 0 {
+		swapPoints(&cc.points[0], &cc.points[rand.Uint64()%cc.poinCount])
+		centInd = 1
+	} else {
+		for _, lock := range cc.locked {
+			center := lock.Color.ToFloatColor()
+			for i := range cc.points {
+				cc.points[i].colorDistance(center)
+			}
+		}
+	}
+	for centInd < cc.freeColors {
 		var sum float64 = 0
-		for i := uint64(centInd + 1); i < cc.poinCount; i++ {
-			sum += cc.points[i].pointDistance(&cc.points[centInd])
+		for i := uint64(centInd); i < cc.poinCount; i++ {
+			if centInd > 0 {
+				sum += cc.points[i].pointDistance(&cc.points[centInd-1])
+			} else {
+				sum += cc.points[i].distance
+			}
 		}
 		rnd := rand.Float64() * sum
-		centInd++
 		sum = 0
 		next := cc.poinCount - 1
-		for i := uint64(centInd + 1); i < cc.poinCount; i++ {
+		for i := uint64(centInd); i < cc.poinCount; i++ {
 			sum += cc.points[i].distance
 			if sum > rnd {
 				next = i
@@ -157,12 +185,16 @@ func (cc *ColorCalc) initCentroids() {
 			}
 		}
 		swapPoints(&cc.points[centInd], &cc.points[next])
+		centInd++
 	}
 
 	cc.centroids = make([]FloatColor, cc.colors)
-	for i := 0; i < cc.colors; i++ {
+	for i := 0; i < cc.freeColors; i++ {
 		cc.centroids[i] = cc.points[i].color
 	}
+	for i, lock := range cc.locked {
+		cc.centroids[cc.freeColors+i] = lock.Color.ToFloatColor()
+	}
 }
 
 func (cc *ColorCalc) calcCentroids() {
@@ -177,7 +209,7 @@ func (cc *ColorCalc) calcCentroids() {
 		c.B += point.color.B * float64(point.count)
 	}
 	cc.totalDistance = 0
-	for i := range cc.centroids {
+	for i := range cc.centroids[:cc.freeColors] {
 		if sizes[i] == 0 {
 			continue
 		}
@@ -311,11 +343,13 @@ func (cc *ColorCalc) Run() {
 }
 
 func (km *ColorCalc) calcPalette() Palette {
-	result := make(Palette, km.colors)
-	for i, c := range km.centroids {
-		result[i] = c.ToIntColor()
+	// Unused free slots stay black
+	free := make(Palette, km.size-len(km.locked))
+	for i, c := range km.centroids[:km.freeColors] {
+		free[i] = c.ToIntColor()
 	}
-	result.Sort()
+	result := km.locked.Apply(free)
+	km.locked.Sort(result)
 	return result
 }
 
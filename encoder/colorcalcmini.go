@@ -156,8 +156,9 @@ func (cc *ColorCalcMini) calcPalette() []FloatColor {
 
 func (cc *ColorCalcMini) GetSubPal(pal Palette) []int {
 	result := make([]int, cc.colors)
+	lookup := pal.Lookup()
 	for i, col := range cc.bestPalette {
-		result[i] = pal.GetFloatColorIndex(col)
+		result[i] = lookup.Nearest(col)
 	}
 	sort.Ints(result)
 	return result
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"math"
 	"os"
 	"sort"
 
+	_ "image/gif"
 	_ "image/jpeg"
 	"image/png"
 
@@ -118,23 +120,31 @@ func (pal Palette) Sort() {
 	sort.Slice(pal, func(i, j int) bool { return pal[i].Luma() < pal[j].Luma() })
 }
 
-func (pal Palette) Save(filename string) {
-	pal.Sort()
-	fo, err := os.Create(filename)
-	if err != nil {
-		panic(err)
-	}
-	defer fo.Close()
-
-	data := make([]byte, 0, pal.Len()*3)
+// First occurrences of colors in the same order
+func (pal Palette) Unique() Palette {
+	result := make(Palette, 0, pal.Len())
+	seen := make(map[IntColor]bool)
 	for _, color := range pal {
-		data = append(data, byte(color.R), byte(color.G), byte(color.B))
-	}
-	_, err = fo.Write(data)
-	if err != nil {
-		panic(err)
+		if !seen[color] {
+			seen[color] = true
+			result = append(result, color)
+		}
 	}
+	return result
+}
 
+func (pal Palette) Save(filename string) error {
+	pal.Sort()
+	return pal.SaveAs(filename, paletteFormatByExt(filename))
+}
+
+// Builds a k-d tree for nearest color lookups, colors are compared with FloatColor.Difference
+func (pal Palette) Lookup() *KDTree {
+	colors := make([]FloatColor, pal.Len())
+	for i, c := range pal {
+		colors[i] = c.ToFloatColor()
+	}
+	return NewKDTree(colors)
 }
 
 func (pal Palette) GetIntColorIndex(color IntColor) int {
@@ -150,6 +160,7 @@ func (pal Palette) GetIntColorIndex(color IntColor) int {
 	return minIndex
 }
 
+// Exhaustive search, Lookup is faster for many colors
 func (pal Palette) GetFloatColorIndex(color FloatColor) int {
 	var minDist float64 = math.MaxFloat64
 	minIndex := 0
@@ -164,21 +175,25 @@ func (pal Palette) GetFloatColorIndex(color FloatColor) int {
 }
 
 func PaletteLoad(filename string) Palette {
-	fi, err := os.ReadFile(filename)
+	result, err := LoadPalette(filename)
 	if err != nil {
 		panic(err)
 	}
-	size := len(fi) / 3
-	result := make(Palette, size)
-	for i := range result {
-		result[i].R = int(fi[i*3])
-		result[i].G = int(fi[i*3+1])
-		result[i].B = int(fi[i*3+2])
-	}
-
 	return result
 }
 
+func LoadPalette(filename string) (Palette, error) {
+	fi, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	result, err := DecodePalette(fi, DetectPaletteFormat(filename, fi))
+	if err != nil {
+		return nil, fmt.Errorf("can't load palette \"%s\": %w", filename, err)
+	}
+	return result, nil
+}
+
 func ImageLoad(filename string) ([]IntColor, int, int, error) {
 	imgFile, err := os.Open(filename)
 	if err != nil {
@@ -228,9 +243,13 @@ func ImageSave(filename string, data []int, width int, height int, pal Palette)
 	return nil
 }
 
-func CalcPalette(input []string) Palette {
-	calc := NewColorCalc(256, 1000, 5)
-	calc.Input(input)
+// Result is sorted by luma around locked colors
+func CalcPalette(input []string, locked LockedColors, sampling ColorSampling) (Palette, error) {
+	calc, err := NewColorCalc(256, 1000, 5, locked)
+	if err != nil {
+		return nil, err
+	}
+	calc.Input(input, sampling)
 	calc.Run()
-	return calc.GetPalette()
+	return calc.GetPalette(), nil
 }
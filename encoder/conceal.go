@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+type ConcealStats struct {
+	Frames       int   // returned frames
+	Concealed    int   // replaced by the previous frame
+	Corrupted    int   // checksum mismatch or decoding error
+	Resyncs      int   // searches of the next frame after broken data
+	SkippedBytes int64 // skipped while searching
+}
+
+func (stats ConcealStats) String() string {
+	return fmt.Sprintf("%d of %d frames concealed (%d corrupted, %d resyncs, %d bytes skipped)",
+		stats.Concealed, stats.Frames, stats.Corrupted, stats.Resyncs, stats.SkippedBytes)
+}
+
+// Decodes frames of RVF file. Broken frame is replaced by the previous one,
+// following frames are replaced too until the next keyframe.
+type RVFDecoder struct {
+	rvf          *RVFReader
+	decoder      *FrameDecoder
+	waitKeyframe bool
+	Stats        ConcealStats
+	OnError      func(frame int, offset int64, err error) // optional
+}
+
+func NewRVFDecoder(rvf *RVFReader) *RVFDecoder {
+	return &RVFDecoder{
+		rvf:     rvf,
+		decoder: NewFrameDecoder(rvf.Header.Width, rvf.Header.Height, rvf.Palette.Len()),
+	}
+}
+
+func (dec *RVFDecoder) report(offset int64, err error) {
+	if dec.OnError != nil {
+		dec.OnError(dec.Stats.Frames, offset, err)
+	}
+}
+
+// Looks for the next frame after broken data at offset
+func (dec *RVFDecoder) resync(offset int64) {
+	dec.waitKeyframe = true
+	if dec.rvf.Header.Flags&CompressionFull == 0 {
+		return
+	}
+	next, err := dec.rvf.FindFrame(offset + 1)
+	if err != nil {
+		next = dec.rvf.framesEnd
+	} else {
+		dec.Stats.Resyncs++
+	}
+	dec.Stats.SkippedBytes += next - offset
+	dec.rvf.SetOffset(next)
+}
+
+// Returns palette indices of the next frame and whether it was concealed.
+// Returns io.EOF after the number of frames from the header, or at the end of file if it is unknown.
+func (dec *RVFDecoder) NextFrame() ([]int, bool, error) {
+	frames := dec.rvf.Header.Frames
+	if frames >= 0 && dec.Stats.Frames >= frames {
+		return nil, false, io.EOF
+	}
+	offset := dec.rvf.Offset()
+	frame, err := dec.rvf.NextFrame()
+	switch {
+	case err == io.EOF && frames < 0:
+		return nil, false, io.EOF
+	case err == io.EOF:
+		// Missing frames are concealed too
+		if !dec.waitKeyframe {
+			dec.report(offset, fmt.Errorf("file has %d frames, header has %d", dec.Stats.Frames, dec.rvf.Header.Frames))
+		}
+		dec.waitKeyframe = true
+	case err != nil:
+		dec.report(offset, err)
+		dec.Stats.Corrupted++
+		dec.resync(offset)
+	case dec.rvf.Header.Flags&CompressionFull == 0:
+		if err = dec.decoder.SetImage(frame.Data); err != nil {
+			dec.report(frame.Offset, err)
+			dec.Stats.Corrupted++
+		} else {
+			dec.waitKeyframe = false
+		}
+	case frame.Corrupted:
+		dec.report(frame.Offset, errors.New("frame checksum mismatch"))
+		dec.Stats.Corrupted++
+		dec.waitKeyframe = true
+	case dec.waitKeyframe && frame.Flags&FrameIsKeyframe == 0:
+	default:
+		if err = dec.decoder.Decode(frame.Data); err != nil {
+			dec.report(frame.Offset, err)
+			dec.Stats.Corrupted++
+			dec.waitKeyframe = true
+		} else {
+			dec.waitKeyframe = false
+		}
+	}
+	concealed := err != nil || dec.waitKeyframe
+	if concealed {
+		dec.Stats.Concealed++
+	}
+	dec.Stats.Frames++
+	return dec.decoder.Image(), concealed, nil
+}
+
+// Decodes the whole file and returns concealment statistics
+func DecodeRVFStats(filename string) (ConcealStats, error) {
+	rvf, err := OpenRVF(filename)
+	if err != nil {
+		return ConcealStats{}, err
+	}
+	defer rvf.Close()
+	dec := NewRVFDecoder(rvf)
+	for {
+		if _, _, err := dec.NextFrame(); err != nil {
+			break
+		}
+	}
+	return dec.Stats, nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"runtime"
 	"sort"
 	"sync"
@@ -11,71 +13,240 @@ type DitheringMethod interface {
 	Process(imageData []IntColor, pal Palette) []int
 }
 
+// Optional interface for methods that collect statistics
+type DitheringStats interface {
+	PrintStats(skipRatio float64) // share of skip blocks in the encoded frames
+}
+
+// Splits pixels into equal ranges (last one takes the rest) and processes them in parallel
+func runWorkers(workers int, rangeSize int, total int, worker func(rangeStart int, rangeEnd int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers-1; i++ {
+		wg.Add(1)
+		go func(rangeStart int, rangeEnd int) {
+			worker(rangeStart, rangeEnd)
+			wg.Done()
+		}(i*rangeSize, (i+1)*rangeSize)
+	}
+	wg.Add(1)
+	go func() {
+		worker((workers-1)*rangeSize, total)
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
 //region POSTERIZE
 
-type PosterizeDithering struct{}
+type PosterizeDithering struct {
+	pc *PalComp
+}
+
+func (dither *PosterizeDithering) Init(pal Palette, pc *PalComp, width int, height int) {
+	dither.pc = pc
+}
 
-func (dither *PosterizeDithering) Init(pal Palette, pc *PalComp, width int, height int) {}
 func (dither *PosterizeDithering) Process(imageData []IntColor, pal Palette) []int {
 	idata := make([]int, len(imageData))
 	for i := range idata {
-		idata[i] = pal.GetFloatColorIndex(imageData[i].ToFloatColor())
+		idata[i] = dither.pc.GetColorIndex(dither.pc.SourceColor(imageData[i]))
 	}
 	return idata
 }
 
 //endregion
 
-//region FLOYD–STEINBERG
+//region ERROR DIFFUSION
+
+func addError(dst *FloatColor, err FloatColor, weight float64) {
+	dst.R = clipFloat(dst.R + err.R*weight)
+	dst.G = clipFloat(dst.G + err.G*weight)
+	dst.B = clipFloat(dst.B + err.B*weight)
+}
+
+// Default source color difference under which pixel keeps its previous index in temporal mode
+const DefaultTemporalTreshold = 0.001
+
+type ErrorDiffusionDithering struct {
+	kernel     *DiffusionKernel
+	strength   float64
+	serpentine bool
+	fdata      []FloatColor
+	width      int
+	height     int
+	pc         *PalComp
 
-func addError(dst *FloatColor, err float64) {
-	dst.R = clipFloat(dst.R + err)
-	dst.G = clipFloat(dst.G + err)
-	dst.B = clipFloat(dst.B + err)
+	// Temporal stability: pixels whose source color barely changed since their index was chosen keep that index
+	temporal    float64
+	refSource   []FloatColor
+	prevIndex   []int
+	heldPixels  uint64
+	totalPixels uint64
 }
 
-type FSDithering struct {
-	fdata  []FloatColor
-	width  int
-	height int
+func NewErrorDiffusionDithering(kernel *DiffusionKernel, strength float64, serpentine bool, temporal float64) *ErrorDiffusionDithering {
+	return &ErrorDiffusionDithering{
+		kernel:     kernel,
+		strength:   strength,
+		serpentine: serpentine,
+		temporal:   temporal,
+	}
 }
 
-func (dither *FSDithering) Init(pal Palette, pc *PalComp, width int, height int) {
+func (dither *ErrorDiffusionDithering) Init(pal Palette, pc *PalComp, width int, height int) {
 	dither.fdata = make([]FloatColor, width*height)
 	dither.width = width
 	dither.height = height
+	dither.pc = pc
+	dither.refSource = nil
+	dither.prevIndex = nil
+	dither.heldPixels = 0
+	dither.totalPixels = 0
 }
 
-func (dither *FSDithering) Process(imageData []IntColor, pal Palette) []int {
+func (dither *ErrorDiffusionDithering) isHeld(index int, source FloatColor) bool {
+	if dither.temporal <= 0 || dither.prevIndex == nil {
+		return false
+	}
+	return source.Difference(dither.refSource[index]) < dither.temporal
+}
+
+func (dither *ErrorDiffusionDithering) PrintStats(skipRatio float64) {
+	if dither.temporal <= 0 || dither.totalPixels == 0 {
+		return
+	}
+	fmt.Printf("  held pixels: %2.f %%   (skip blocks: %2.f %%)\n", float64(dither.heldPixels)/float64(dither.totalPixels)*100, skipRatio*100)
+}
+
+func (dither *ErrorDiffusionDithering) Process(imageData []IntColor, pal Palette) []int {
 	idata := make([]int, dither.width*dither.height)
 
 	for i := range dither.fdata {
-		dither.fdata[i] = imageData[i].ToFloatColor()
+		dither.fdata[i] = dither.pc.SourceColor(imageData[i])
+	}
+
+	held := make([]bool, len(idata))
+	if dither.temporal > 0 {
+		if dither.prevIndex == nil {
+			dither.refSource = make([]FloatColor, len(idata))
+			dither.prevIndex = make([]int, len(idata))
+		} else {
+			for i := range held {
+				held[i] = dither.isHeld(i, dither.fdata[i])
+			}
+		}
 	}
 
 	for y := 0; y < dither.height; y++ {
-		for x := 0; x < dither.width; x++ {
+		// Odd rows go right to left in serpentine mode, kernel is mirrored
+		reverse := dither.serpentine && y%2 == 1
+		for i := 0; i < dither.width; i++ {
+			x := i
+			if reverse {
+				x = dither.width - 1 - i
+			}
 			index := y*dither.width + x
 			oldColor := dither.fdata[index]
-			newColorIndex := pal.GetFloatColorIndex(oldColor)
-			newColor := pal[newColorIndex].ToFloatColor()
+			var newColorIndex int
+			if held[index] {
+				newColorIndex = dither.prevIndex[index]
+				dither.heldPixels++
+			} else {
+				newColorIndex = dither.pc.GetColorIndex(oldColor)
+			}
+			newColor := dither.pc.ToFloatColor(newColorIndex)
 			idata[index] = newColorIndex
 			dither.fdata[index] = newColor
-			colError := (oldColor.R - newColor.R + oldColor.G - newColor.G + oldColor.B - newColor.B) / 3
-			if x < dither.width-1 {
-				addError(&dither.fdata[y*dither.width+x+1], colError*7.0/16.0)
+			colError := FloatColor{
+				R: oldColor.R - newColor.R,
+				G: oldColor.G - newColor.G,
+				B: oldColor.B - newColor.B,
 			}
-			if y < dither.height-1 {
-				if x > 0 {
-					addError(&dither.fdata[(y+1)*dither.width+x-1], colError*3.0/16.0)
+			for _, entry := range dither.kernel.Entries {
+				dx := entry.DX
+				if reverse {
+					dx = -dx
 				}
-				addError(&dither.fdata[(y+1)*dither.width+x], colError*5.0/16.0)
-				if x < dither.width-1 {
-					addError(&dither.fdata[(y+1)*dither.width+x+1], colError*1.0/16.0)
+				nx := x + dx
+				ny := y + entry.DY
+				if nx < 0 || nx >= dither.width || ny >= dither.height {
+					continue
 				}
+				addError(&dither.fdata[ny*dither.width+nx], colError, entry.Weight/dither.kernel.Divisor*dither.strength)
 			}
 		}
 	}
+
+	if dither.temporal > 0 {
+		for i := range idata {
+			if !held[i] {
+				dither.refSource[i] = dither.pc.SourceColor(imageData[i])
+			}
+		}
+		copy(dither.prevIndex, idata)
+		dither.totalPixels += uint64(len(idata))
+	}
+	return idata
+}
+
+//endregion
+
+//region RIEMERSMA
+
+const riemersmaQueueSize = 16
+const riemersmaMaxWeight = 16.0
+
+// Error diffusion along the Hilbert curve: error of the last pixels is kept in a queue,
+// with weights growing exponentially from 1 (oldest) to riemersmaMaxWeight (newest)
+type RiemersmaDithering struct {
+	strength float64
+	width    int
+	height   int
+	curve    []int
+	weights  [riemersmaQueueSize]float64
+	pc       *PalComp
+}
+
+func NewRiemersmaDithering(strength float64) *RiemersmaDithering {
+	return &RiemersmaDithering{strength: strength}
+}
+
+func (dither *RiemersmaDithering) Init(pal Palette, pc *PalComp, width int, height int) {
+	dither.width = width
+	dither.height = height
+	dither.curve = GetHilbertCurve(width, height)
+	dither.pc = pc
+	multiplier := 1.0
+	step := math.Exp(math.Log(riemersmaMaxWeight) / (riemersmaQueueSize - 1))
+	for i := range dither.weights {
+		dither.weights[i] = multiplier / riemersmaMaxWeight * dither.strength
+		multiplier *= step
+	}
+}
+
+func (dither *RiemersmaDithering) Process(imageData []IntColor, pal Palette) []int {
+	idata := make([]int, dither.width*dither.height)
+	var queue [riemersmaQueueSize]FloatColor
+
+	for _, index := range dither.curve {
+		source := dither.pc.SourceColor(imageData[index])
+		color := source
+		for i, qerr := range queue {
+			color.R += qerr.R * dither.weights[i]
+			color.G += qerr.G * dither.weights[i]
+			color.B += qerr.B * dither.weights[i]
+		}
+		newColorIndex := dither.pc.GetColorIndex(color.Normalized())
+		newColor := dither.pc.ToFloatColor(newColorIndex)
+		idata[index] = newColorIndex
+
+		copy(queue[:], queue[1:])
+		queue[riemersmaQueueSize-1] = FloatColor{
+			R: source.R - newColor.R,
+			G: source.G - newColor.G,
+			B: source.B - newColor.B,
+		}
+	}
 	return idata
 }
 
@@ -86,6 +257,7 @@ func (dither *FSDithering) Process(imageData []IntColor, pal Palette) []int {
 type PatternDithering struct {
 	width     int
 	height    int
+	source    *Pattern
 	pattern   *Pattern
 	fdata     []FloatColor
 	workers   int
@@ -99,7 +271,7 @@ func NewPatternDithering(pattern *Pattern, workers int, treshold float64) *Patte
 		workers = runtime.NumCPU()
 	}
 	return &PatternDithering{
-		pattern:  pattern,
+		source:   pattern,
 		workers:  workers,
 		treshold: treshold,
 	}
@@ -108,7 +280,7 @@ func NewPatternDithering(pattern *Pattern, workers int, treshold float64) *Patte
 func (dither *PatternDithering) Init(pal Palette, pc *PalComp, width int, height int) {
 	dither.width = width
 	dither.height = height
-	dither.pattern = dither.pattern.Reshape(width, height)
+	dither.pattern = dither.source.Reshape(width, height)
 	dither.fdata = make([]FloatColor, width*height)
 	dither.rangeSize = width * height / dither.workers
 	dither.pc = pc
@@ -118,12 +290,13 @@ func (dither *PatternDithering) Process(imageData []IntColor, pal Palette) []int
 	idata := make([]int, dither.width*dither.height)
 
 	for i := range dither.fdata {
-		dither.fdata[i] = imageData[i].ToFloatColor()
+		dither.fdata[i] = dither.pc.SourceColor(imageData[i])
 	}
 
-	var wg sync.WaitGroup
-
-	workerFunc := func(wdata []FloatColor, widata []int, wpattern []int) {
+	runWorkers(dither.workers, dither.rangeSize, len(idata), func(rangeStart int, rangeEnd int) {
+		wdata := dither.fdata[rangeStart:rangeEnd]
+		widata := idata[rangeStart:rangeEnd]
+		wpattern := dither.pattern.Data[rangeStart:rangeEnd]
 		candidates := make([]int, dither.pattern.Order)
 		for p := range wdata {
 			cerr := FloatColor{0, 0, 0}
@@ -143,36 +316,32 @@ func (dither *PatternDithering) Process(imageData []IntColor, pal Palette) []int
 			sort.Ints(candidates[:])
 			widata[p] = candidates[wpattern[p]]
 		}
-		wg.Done()
-	}
+	})
 
-	for i := 0; i < dither.workers-1; i++ {
-		rangeStart := i * dither.rangeSize
-		rangeEnd := (i + 1) * dither.rangeSize
-		wg.Add(1)
-		go workerFunc(dither.fdata[rangeStart:rangeEnd], idata[rangeStart:rangeEnd], dither.pattern.Data[rangeStart:rangeEnd])
-	}
-	rangeStart := (dither.workers - 1) * dither.rangeSize
-	wg.Add(1)
-	go workerFunc(dither.fdata[rangeStart:], idata[rangeStart:], dither.pattern.Data[rangeStart:])
-
-	wg.Wait()
 	return idata
 }
 
 //endregion
 
-func FindDithering(name string) DitheringMethod {
-	switch name {
-	case "none":
-		return &PosterizeDithering{}
-	case "fs":
-		return &FSDithering{}
-	case "pat8":
-		return NewPatternDithering(bayerMatrixBig, -1, 0.5)
-	case "pat4":
-		return NewPatternDithering(bayerMatrixSmall, -1, 0.5)
-	default:
-		return nil
+//region GAMMA
+
+// Runs a method with palette and source colors in linear light
+type LinearDithering struct {
+	method DitheringMethod
+}
+
+func (dither *LinearDithering) Init(pal Palette, pc *PalComp, width int, height int) {
+	dither.method.Init(pal, NewLinearPalComp(pal), width, height)
+}
+
+func (dither *LinearDithering) Process(imageData []IntColor, pal Palette) []int {
+	return dither.method.Process(imageData, pal)
+}
+
+func (dither *LinearDithering) PrintStats(skipRatio float64) {
+	if stats, ok := dither.method.(DitheringStats); ok {
+		stats.PrintStats(skipRatio)
 	}
 }
+
+//endregion
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dithering method is specified as name[:param=value,flag,...], for example
+//   fs:strength=0.8,serpentine
+//   pat8:threshold=0.3,gamma=linear
+//   pattern:file=noise.png,workers=4
+// Older forms <kernel>[-serpentine][-temporal] and pattern:<file> are still accepted.
+
+type ditheringParams struct {
+	method string
+	values map[string]string
+	keys   []string
+	used   map[string]bool
+	err    error
+}
+
+func parseDitheringParams(spec string) (*ditheringParams, error) {
+	name, rest, hasParams := strings.Cut(spec, ":")
+	params := &ditheringParams{
+		method: strings.ToLower(strings.TrimSpace(name)),
+		values: make(map[string]string),
+		used:   make(map[string]bool),
+	}
+	if params.method == "" {
+		return nil, fmt.Errorf("empty dithering method")
+	}
+	// Old modifiers (fs-serpentine-temporal) are flags
+	modifiers := strings.Split(params.method, "-")
+	params.method = modifiers[0]
+	for _, modifier := range modifiers[1:] {
+		if err := params.set(modifier, ""); err != nil {
+			return nil, err
+		}
+	}
+	if !hasParams {
+		return params, nil
+	}
+	if params.method == "pattern" && !strings.Contains(rest, "=") {
+		rest = "file=" + rest
+	}
+	for _, item := range strings.Split(rest, ",") {
+		key, value, _ := strings.Cut(item, "=")
+		if strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("wrong parameter \"%s\" of dithering method \"%s\"", item, params.method)
+		}
+		if err := params.set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+func (params *ditheringParams) set(key string, value string) error {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if key == "" {
+		return fmt.Errorf("empty parameter of dithering method \"%s\"", params.method)
+	}
+	if _, ok := params.values[key]; ok {
+		return fmt.Errorf("parameter \"%s\" of dithering method \"%s\" is set twice", key, params.method)
+	}
+	params.values[key] = strings.TrimSpace(value)
+	params.keys = append(params.keys, key)
+	return nil
+}
+
+func (params *ditheringParams) lookup(name string) (string, bool) {
+	params.used[name] = true
+	value, ok := params.values[name]
+	return value, ok
+}
+
+func (params *ditheringParams) fail(format string, args ...any) {
+	if params.err == nil {
+		params.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (params *ditheringParams) Float(name string, def float64, min float64, max float64) float64 {
+	value, ok := params.lookup(name)
+	if !ok {
+		return def
+	}
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil || result < min || result > max {
+		params.fail("parameter \"%s\" of dithering method \"%s\" must be a number from %g to %g", name, params.method, min, max)
+		return def
+	}
+	return result
+}
+
+func (params *ditheringParams) Int(name string, def int, min int, max int) int {
+	value, ok := params.lookup(name)
+	if !ok {
+		return def
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < min || result > max {
+		params.fail("parameter \"%s\" of dithering method \"%s\" must be an integer from %d to %d", name, params.method, min, max)
+		return def
+	}
+	return result
+}
+
+// Flag is set by its name alone or by name=true/false
+func (params *ditheringParams) Flag(name string) bool {
+	value, ok := params.lookup(name)
+	if !ok {
+		return false
+	}
+	if value == "" {
+		return true
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		params.fail("parameter \"%s\" of dithering method \"%s\" must be true or false", name, params.method)
+		return false
+	}
+	return result
+}
+
+// Number that can also be set as a flag: name alone or name=true gives def, name=false gives 0
+func (params *ditheringParams) FlagFloat(name string, def float64, min float64, max float64) float64 {
+	value, ok := params.lookup(name)
+	if !ok {
+		return 0
+	}
+	if value == "" {
+		return def
+	}
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if enabled {
+			return def
+		}
+		return 0
+	}
+	return params.Float(name, def, min, max)
+}
+
+func (params *ditheringParams) String(name string, def string) string {
+	value, ok := params.lookup(name)
+	if !ok {
+		return def
+	}
+	if value == "" {
+		params.fail("parameter \"%s\" of dithering method \"%s\" needs a value", name, params.method)
+		return def
+	}
+	return value
+}
+
+func (params *ditheringParams) Choice(name string, def string, options ...string) string {
+	value := strings.ToLower(params.String(name, def))
+	for _, option := range options {
+		if value == option {
+			return value
+		}
+	}
+	params.fail("parameter \"%s\" of dithering method \"%s\" must be one of: %s", name, params.method, strings.Join(options, ", "))
+	return def
+}
+
+// First error or parameter that was not used by the method
+func (params *ditheringParams) Err() error {
+	if params.err != nil {
+		return params.err
+	}
+	for _, key := range params.keys {
+		if !params.used[key] {
+			return fmt.Errorf("unknown parameter \"%s\" of dithering method \"%s\"", key, params.method)
+		}
+	}
+	return nil
+}
+
+func ditheringMethodNames() []string {
+	result := []string{"none", "pat8", "pat4", "pattern", "riemersma", "yliluoma1", "yliluoma2", "yliluoma3"}
+	kernels := make([]string, 0, len(diffusionKernels))
+	for name := range diffusionKernels {
+		kernels = append(kernels, name)
+	}
+	sort.Strings(kernels)
+	return append(result, kernels...)
+}
+
+func (params *ditheringParams) workers() int {
+	return params.Int("workers", -1, 1, 1024)
+}
+
+func (params *ditheringParams) pattern(def *Pattern) *Pattern {
+	filename := params.String("file", "")
+	if filename == "" {
+		if def == nil {
+			params.fail("dithering method \"%s\" needs a pattern file (%s:file=<pattern>)", params.method, params.method)
+		}
+		return def
+	}
+	pattern, err := LoadPattern(filename)
+	if err != nil {
+		params.fail("%w", err)
+	}
+	return pattern
+}
+
+func (params *ditheringParams) build() DitheringMethod {
+	switch params.method {
+	case "none":
+		return &PosterizeDithering{}
+	case "pat8":
+		return NewPatternDithering(bayerMatrixBig, params.workers(), params.Float("threshold", 0.5, 0, 1))
+	case "pat4":
+		return NewPatternDithering(bayerMatrixSmall, params.workers(), params.Float("threshold", 0.5, 0, 1))
+	case "pattern":
+		pattern := params.pattern(nil)
+		if pattern == nil {
+			return nil
+		}
+		return NewPatternDithering(pattern, params.workers(), params.Float("threshold", 0.5, 0, 1))
+	case "riemersma":
+		return NewRiemersmaDithering(params.Float("strength", 1.0, 0, 2))
+	case "yliluoma1":
+		return NewYliluomaDithering(1, params.pattern(bayerMatrixBig), params.workers())
+	case "yliluoma2":
+		return NewYliluomaDithering(2, params.pattern(bayerMatrixBig), params.workers())
+	case "yliluoma3":
+		return NewYliluomaDithering(3, params.pattern(bayerMatrixBig), params.workers())
+	}
+
+	kernel, ok := diffusionKernels[params.method]
+	if !ok {
+		params.fail("unknown dithering method \"%s\" (available: %s)", params.method, strings.Join(ditheringMethodNames(), ", "))
+		return nil
+	}
+	strength := params.Float("strength", 1.0, 0, 2)
+	serpentine := params.Flag("serpentine")
+	temporal := params.FlagFloat("temporal", DefaultTemporalTreshold, 0, 1)
+	return NewErrorDiffusionDithering(kernel, strength, serpentine, temporal)
+}
+
+// Parses method specification, every method accepts gamma=srgb|linear
+func FindDithering(spec string) (DitheringMethod, error) {
+	params, err := parseDitheringParams(spec)
+	if err != nil {
+		return nil, err
+	}
+	method := params.build()
+	if method != nil && params.Choice("gamma", "srgb", "srgb", "linear") == "linear" {
+		method = &LinearDithering{method}
+	}
+	if err := params.Err(); err != nil {
+		return nil, err
+	}
+	return method, nil
+}
@@ -499,6 +499,11 @@ func (encoder *FrameEncoder) Pack() []byte {
 	return result
 }
 
+// Next frame is encoded without references to the previous one
+func (encoder *FrameEncoder) ForceKeyframe() {
+	encoder.lastFrame = nil
+}
+
 func (encoder *FrameEncoder) IsClean() bool {
 	for _, block := range encoder.chain {
 		if block.BlockType == ENC_SKIP || block.BlockType == ENC_SKIP_LONG {
@@ -508,13 +513,22 @@ func (encoder *FrameEncoder) IsClean() bool {
 	return true
 }
 
-func (encoder *FrameEncoder) PrintStats() {
+func (encoder *FrameEncoder) statsTotal() float64 {
 	total := uint(0)
 	for _, count := range encoder.stats {
 		total += count
 	}
-	ftotal := float64(total)
-	fmt.Printf("  skip:   %2.f %%\n", float64(encoder.stats[ENC_SKIP])/ftotal*100)
+	return float64(total)
+}
+
+// Share of skip blocks in all encoded frames
+func (encoder *FrameEncoder) SkipRatio() float64 {
+	return float64(encoder.stats[ENC_SKIP]) / encoder.statsTotal()
+}
+
+func (encoder *FrameEncoder) PrintStats() {
+	ftotal := encoder.statsTotal()
+	fmt.Printf("  skip:   %2.f %%\n", encoder.SkipRatio()*100)
 	fmt.Printf("  repeat: %2.f %%\n", float64(encoder.stats[ENC_REPEAT])/ftotal*100)
 	fmt.Printf("  solid:  %2.f %%\n", float64(encoder.stats[ENC_SOLID])/ftotal*100)
 	fmt.Printf("  pal2:   %2.f %%\n", float64(encoder.stats[ENC_PAL2])/ftotal*100)
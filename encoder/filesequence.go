@@ -12,7 +12,7 @@ import (
 
 var regexRange = regexp.MustCompile(`^(.*?)\{\s*(\d+),\s*(\d+)\s*-\s*(\d+)\s*\}(.*)$`)
 var regexIndex = regexp.MustCompile(`^(.*?)%(\d+)%(.*)$`)
-var regexExt = regexp.MustCompile(`\.(tiff|tif|png|jpg|jpeg)$`)
+var regexExt = regexp.MustCompile(`\.(tiff|tif|png|jpg|jpeg|gif)$`)
 
 type IndexedFilename struct {
 	Filename string
@@ -20,7 +20,7 @@ type IndexedFilename struct {
 }
 
 // Formats:
-// - folder                 (all image files: *.png, *.jpg, *.jpeg, *.tif, *.tiff)
+// - folder                 (all image files: *.png, *.jpg, *.jpeg, *.tif, *.tiff, *.gif)
 // - file1, file2, file3    (all listed existing files)
 // - filename%5%.ext        (all files that match pattern, sorted by index)
 // - filename{5,1-205}.ext  (all files that match pattern, sorted by index)
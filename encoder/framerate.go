@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"math"
+)
+
+// Converts frame rate of a source by dropping or repeating frames.
+// Output frame n covers time [n/outRate, (n+1)/outRate) and shows the source frame at the middle of it,
+// or in blending mode the mix of all source frames weighted by their overlap with that time.
+// Frame exists while its middle is inside the source, so the duration stays the same (within half a frame).
+type RateConverter struct {
+	source    FrameSource
+	inRate    float64
+	outRate   float64
+	blend     bool
+	index     int
+	buffer    []Frame
+	bufferPos int // source index of buffer[0]
+	eof       bool
+}
+
+func NewRateConverter(source FrameSource, inRate float64, outRate float64, blend bool) *RateConverter {
+	return &RateConverter{
+		source:  source,
+		inRate:  inRate,
+		outRate: outRate,
+		blend:   blend,
+	}
+}
+
+func (conv *RateConverter) Size() (int, int) {
+	return conv.source.Size()
+}
+
+func (conv *RateConverter) FrameRate() float64 {
+	return conv.outRate
+}
+
+func (conv *RateConverter) FrameCount() int {
+	count := conv.source.FrameCount()
+	if count < 0 {
+		return -1
+	}
+	return int(math.Ceil(float64(count)*conv.outRate/conv.inRate - 0.5))
+}
+
+// Source frame by index, earlier frames must not be requested after later ones
+func (conv *RateConverter) frame(index int) (Frame, bool, error) {
+	for len(conv.buffer) > 0 && conv.bufferPos < index {
+		conv.buffer = conv.buffer[1:]
+		conv.bufferPos++
+	}
+	for !conv.eof && conv.bufferPos+len(conv.buffer) <= index {
+		frame, err := conv.source.Next()
+		if err == io.EOF {
+			conv.eof = true
+			break
+		}
+		if err != nil {
+			return Frame{}, false, err
+		}
+		if len(conv.buffer) == 0 && conv.bufferPos < index {
+			// skipped frame
+			conv.bufferPos++
+			continue
+		}
+		conv.buffer = append(conv.buffer, frame)
+	}
+	if index-conv.bufferPos >= len(conv.buffer) {
+		return Frame{}, false, nil
+	}
+	return conv.buffer[index-conv.bufferPos], true, nil
+}
+
+func (conv *RateConverter) Next() (Frame, error) {
+	start := float64(conv.index) / conv.outRate
+	end := float64(conv.index+1) / conv.outRate
+	middle := int(math.Floor((start + end) / 2 * conv.inRate))
+	if !conv.blend {
+		frame, ok, err := conv.frame(middle)
+		if err != nil {
+			return Frame{}, err
+		}
+		if !ok {
+			return Frame{}, io.EOF
+		}
+		conv.index++
+		return frame, nil
+	}
+
+	first := int(math.Floor(start * conv.inRate))
+	last := int(math.Ceil(end*conv.inRate)) - 1
+	frames := make([]Frame, 0, last-first+1)
+	weights := make([]float64, 0, last-first+1)
+	total := 0.0
+	for i := first; i <= last; i++ {
+		frame, ok, err := conv.frame(i)
+		if err != nil {
+			return Frame{}, err
+		}
+		if !ok {
+			if i <= middle {
+				return Frame{}, io.EOF
+			}
+			break
+		}
+		overlap := math.Min(end, float64(i+1)/conv.inRate) - math.Max(start, float64(i)/conv.inRate)
+		if overlap <= 0 {
+			continue
+		}
+		frames = append(frames, frame)
+		weights = append(weights, overlap)
+		total += overlap
+	}
+	conv.index++
+	return blendFrames(frames, weights, total), nil
+}
+
+// Frames of different size are not mixed, the one with the biggest weight is used
+func blendFrames(frames []Frame, weights []float64, total float64) Frame {
+	dominant := 0
+	for i := range frames {
+		if weights[i] > weights[dominant] {
+			dominant = i
+		}
+	}
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	for _, frame := range frames {
+		if frame.Width != frames[dominant].Width || frame.Height != frames[dominant].Height {
+			return frames[dominant]
+		}
+	}
+	acc := make([]FloatColor, len(frames[dominant].Data))
+	for i, frame := range frames {
+		weight := weights[i] / total
+		for j, color := range frame.Data {
+			acc[j].R += float64(color.R) * weight
+			acc[j].G += float64(color.G) * weight
+			acc[j].B += float64(color.B) * weight
+		}
+	}
+	result := make([]IntColor, len(acc))
+	for j, color := range acc {
+		result[j] = IntColor{
+			clipInt(int(math.Round(color.R))),
+			clipInt(int(math.Round(color.G))),
+			clipInt(int(math.Round(color.B))),
+		}
+	}
+	return Frame{result, frames[dominant].Width, frames[dominant].Height}
+}
+
+func (conv *RateConverter) Close() error {
+	return conv.source.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Frame struct {
+	Data   []IntColor
+	Width  int
+	Height int
+}
+
+// Source of video frames for encoding
+type FrameSource interface {
+	Size() (int, int)   // size of the first frame, others may differ
+	FrameRate() float64 // 0 if source has no frame rate
+	FrameCount() int    // -1 if unknown until the end of stream
+	Next() (Frame, error)
+	Close() error
+}
+
+// Input formats:
+// - "-" or *.y4m           (YUV4MPEG2 stream from stdin or file)
+// - *.gif, animated *.png  (animation, resampled to frameRate)
+// - anything else          (image sequence, see listFiles)
+func OpenFrameSource(input string, frameRate float64) (FrameSource, error) {
+	ext := strings.ToLower(filepath.Ext(input))
+	if input == "-" || ext == ".y4m" {
+		return OpenY4M(input)
+	}
+	info, err := os.Stat(input)
+	isFile := err == nil && !info.IsDir()
+	if isFile && ext == ".gif" {
+		return LoadGIF(input, frameRate)
+	}
+	if isFile && ext == ".png" && IsAPNG(input) {
+		return LoadAPNG(input, frameRate)
+	}
+	files := listFiles(input)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("can't find any files")
+	}
+	return NewImageSequence(files)
+}
+
+//region IMAGE SEQUENCE
+
+type ImageSequence struct {
+	files  []string
+	width  int
+	height int
+	index  int
+}
+
+func NewImageSequence(files []string) (*ImageSequence, error) {
+	_, width, height, err := ImageLoad(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("can't load image \"%s\": %w", files[0], err)
+	}
+	return &ImageSequence{
+		files:  files,
+		width:  width,
+		height: height,
+	}, nil
+}
+
+func (seq *ImageSequence) Size() (int, int) {
+	return seq.width, seq.height
+}
+
+func (seq *ImageSequence) FrameRate() float64 {
+	return 0
+}
+
+func (seq *ImageSequence) FrameCount() int {
+	return len(seq.files)
+}
+
+func (seq *ImageSequence) Next() (Frame, error) {
+	if seq.index >= len(seq.files) {
+		return Frame{}, io.EOF
+	}
+	file := seq.files[seq.index]
+	seq.index++
+	imageColorData, fwidth, fheight, err := ImageLoad(file)
+	if err != nil {
+		return Frame{}, fmt.Errorf("can't load image \"%s\": %w", file, err)
+	}
+	return Frame{imageColorData, fwidth, fheight}, nil
+}
+
+func (seq *ImageSequence) Close() error {
+	return nil
+}
+
+//endregion
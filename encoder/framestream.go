@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// One operation of a packed frame
+type FrameOp struct {
+	Code   byte // ENC_* including long variants
+	Count  int  // blocks
+	Offset int  // in frame data
+	Size   int  // in bytes, including opcode
+}
+
+var opcodeNames = map[byte]string{
+	ENC_SKIP:           "skip",
+	ENC_SKIP_LONG:      "skip_long",
+	ENC_REPEAT:         "repeat",
+	ENC_REPEAT_LONG:    "repeat_long",
+	ENC_SOLID:          "solid",
+	ENC_SOLID_LONG:     "solid_long",
+	ENC_SOLID_SEP:      "solid_sep",
+	ENC_SOLID_SEP_LONG: "solid_sep_long",
+	ENC_PAL2:           "pal2",
+	ENC_PAL2_CACHE:     "pal2_cache",
+	ENC_PAL4:           "pal4",
+	ENC_PAL4_CACHE:     "pal4_cache",
+	ENC_PAL8:           "pal8",
+	ENC_PAL8_CACHE:     "pal8_cache",
+	ENC_RAW:            "raw",
+	ENC_RAW_LONG:       "raw_long",
+}
+
+var ErrUnsupportedOp = errors.New("unsupported operation")
+
+func isLongOp(code byte) bool {
+	switch code {
+	case ENC_SKIP_LONG, ENC_REPEAT_LONG, ENC_SOLID_LONG, ENC_SOLID_SEP_LONG, ENC_RAW_LONG:
+		return true
+	}
+	return false
+}
+
+// Bytes after the opcode and length
+func opPayloadSize(code byte, count int) int {
+	switch code {
+	case ENC_SOLID, ENC_SOLID_LONG:
+		return 1
+	case ENC_PAL2:
+		return 2 + 2*count
+	case ENC_PAL2_CACHE:
+		return 1 + 2*count
+	case ENC_PAL4:
+		return 4 + 4*count
+	case ENC_PAL4_CACHE:
+		return 1 + 4*count
+	case ENC_PAL8:
+		return 8 + 6*count
+	case ENC_PAL8_CACHE:
+		return 1 + 6*count
+	case ENC_RAW, ENC_RAW_LONG:
+		return 16 * count
+	}
+	return 0
+}
+
+// Reads operation at offset
+func ReadFrameOp(data []byte, offset int) (FrameOp, error) {
+	code := data[offset] & 0xF0
+	op := FrameOp{Code: code, Offset: offset}
+	if isLongOp(code) {
+		if offset+1 >= len(data) {
+			return op, fmt.Errorf("truncated %s", opcodeNames[code])
+		}
+		op.Count = int(data[offset]&0x0F)<<8 + int(data[offset+1]) + 1
+		op.Size = 2
+	} else {
+		op.Count = int(data[offset]&0x0F) + 1
+		op.Size = 1
+	}
+	if code == ENC_SOLID_SEP || code == ENC_SOLID_SEP_LONG {
+		return op, fmt.Errorf("%w %s", ErrUnsupportedOp, opcodeNames[code])
+	}
+	op.Size += opPayloadSize(code, op.Count)
+	if offset+op.Size > len(data) {
+		return op, fmt.Errorf("truncated %s", opcodeNames[code])
+	}
+	return op, nil
+}
+
+// Walks all operations of a packed frame and returns the number of blocks they cover,
+// error contains the offset of the broken operation
+func ScanFrame(data []byte, visit func(op FrameOp)) (int, error) {
+	blocks := 0
+	for offset := 0; offset < len(data); {
+		op, err := ReadFrameOp(data, offset)
+		if err != nil {
+			return blocks, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if visit != nil {
+			visit(op)
+		}
+		blocks += op.Count
+		offset += op.Size
+	}
+	return blocks, nil
+}
+
+// Reads pixels of a block packed with bits per pixel, most significant bits first
+func unpackBits(data []byte, bits int) ImageBlock {
+	var result ImageBlock
+	pos := 0
+	for i := range result {
+		for b := 0; b < bits; b++ {
+			result[i] = result[i]<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+	}
+	return result
+}
+
+// Decodes packed frames, blocks of the previous frame are kept for skips
+type FrameDecoder struct {
+	width      int
+	height     int
+	blockWidth int
+	colors     int
+	order      []int // block position on the curve for every block of the image
+	blocks     []ImageBlock
+	next       []ImageBlock
+	palcache   [3]*PaletteCache
+}
+
+func NewFrameDecoder(width int, height int, colors int) *FrameDecoder {
+	blockWidth := (width + 3) / 4
+	blockHeight := (height + 3) / 4
+	curve := GetHilbertCurve(blockWidth, blockHeight)
+	order := make([]int, len(curve))
+	for i, n := range curve {
+		order[n] = i
+	}
+	return &FrameDecoder{
+		width:      width,
+		height:     height,
+		blockWidth: blockWidth,
+		colors:     colors,
+		order:      order,
+		blocks:     make([]ImageBlock, len(curve)),
+		next:       make([]ImageBlock, len(curve)),
+		palcache:   [3]*PaletteCache{NewPaletteCache(), NewPaletteCache(), NewPaletteCache()},
+	}
+}
+
+func (decoder *FrameDecoder) readColors(data []byte) ([]int, error) {
+	result := make([]int, len(data))
+	for i, color := range data {
+		if int(color) >= decoder.colors {
+			return nil, fmt.Errorf("color %d is out of palette (%d colors)", color, decoder.colors)
+		}
+		result[i] = int(color)
+	}
+	return result, nil
+}
+
+func (decoder *FrameDecoder) decodeOp(data []byte, op FrameOp, block int) error {
+	if block+op.Count > len(decoder.next) {
+		return fmt.Errorf("%s of %d blocks overflows the frame (%d blocks)", opcodeNames[op.Code], op.Count, len(decoder.next))
+	}
+	payload := data[op.Offset+op.Size-opPayloadSize(op.Code, op.Count) : op.Offset+op.Size]
+	blocks := decoder.next[block : block+op.Count]
+	switch op.Code {
+	case ENC_SKIP, ENC_SKIP_LONG:
+	case ENC_REPEAT, ENC_REPEAT_LONG:
+		if block == 0 {
+			return errors.New("repeat without previous block")
+		}
+		for i := range blocks {
+			blocks[i] = decoder.next[block-1]
+		}
+	case ENC_SOLID, ENC_SOLID_LONG:
+		color, err := decoder.readColors(payload)
+		if err != nil {
+			return err
+		}
+		for i := range blocks {
+			for j := range blocks[i] {
+				blocks[i][j] = color[0]
+			}
+		}
+	case ENC_PAL2, ENC_PAL2_CACHE, ENC_PAL4, ENC_PAL4_CACHE, ENC_PAL8, ENC_PAL8_CACHE:
+		colors, cache := encodingToColors(op.Code)
+		palcache := decoder.palcache[cache]
+		var pal []int
+		switch op.Code {
+		case ENC_PAL2, ENC_PAL4, ENC_PAL8:
+			var err error
+			if pal, err = decoder.readColors(payload[:colors]); err != nil {
+				return err
+			}
+			palcache.AddPalette(pal)
+			payload = payload[colors:]
+		default:
+			index := int(payload[0])
+			if index >= palcache.Count {
+				return fmt.Errorf("%s index %d refers to missing palette (%d in cache)", opcodeNames[op.Code], index, palcache.Count)
+			}
+			pal = palcache.Pals[index]
+			payload = payload[1:]
+		}
+		bits := map[int]int{2: 1, 4: 2, 8: 3}[colors]
+		for i := range blocks {
+			blocks[i] = unpackBits(payload[i*2*bits:], bits)
+			for j, color := range blocks[i] {
+				blocks[i][j] = pal[color]
+			}
+		}
+	case ENC_RAW, ENC_RAW_LONG:
+		colors, err := decoder.readColors(payload)
+		if err != nil {
+			return err
+		}
+		for i := range blocks {
+			copy(blocks[i][:], colors[i*16:])
+		}
+	}
+	return nil
+}
+
+// Decodes frame over the previous one, on error the previous frame stays unchanged
+func (decoder *FrameDecoder) Decode(data []byte) error {
+	copy(decoder.next, decoder.blocks)
+	for _, palcache := range decoder.palcache {
+		palcache.Reset()
+	}
+	block := 0
+	for offset := 0; offset < len(data); {
+		op, err := ReadFrameOp(data, offset)
+		if err == nil {
+			err = decoder.decodeOp(data, op, block)
+		}
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", offset, err)
+		}
+		block += op.Count
+		offset += op.Size
+	}
+	decoder.blocks, decoder.next = decoder.next, decoder.blocks
+	return nil
+}
+
+// Sets the current frame from uncompressed data
+func (decoder *FrameDecoder) SetImage(image []byte) error {
+	colors, err := decoder.readColors(image)
+	if err != nil {
+		return err
+	}
+	blocks, _, _ := ImageToBlocks(colors, decoder.width, decoder.height)
+	for i, n := range decoder.order {
+		decoder.blocks[n] = blocks[i]
+	}
+	return nil
+}
+
+// Palette indices of the current frame
+func (decoder *FrameDecoder) Image() []int {
+	result := make([]int, decoder.width*decoder.height)
+	for y := 0; y < decoder.height; y++ {
+		for x := 0; x < decoder.width; x++ {
+			block := decoder.blocks[decoder.order[x/4+y/4*decoder.blockWidth]]
+			result[x+y*decoder.width] = block[x%4+y%4*4]
+		}
+	}
+	return result
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const DefaultHistogramColors = 1 << 20
+
+const minHistogramBits = 4
+
+type ColorSampling struct {
+	FrameStep int // use every Nth frame
+	PixelStep int // use every Nth pixel of a frame
+	MaxColors int // histogram precision is reduced when it has more colors than that
+}
+
+// Sparse color histogram with adaptive precision, so its size stays bounded for any input
+type ColorHistogram struct {
+	bins  map[uint32]uint64
+	bits  int
+	limit int
+}
+
+func NewColorHistogram(limit int) *ColorHistogram {
+	if limit < 1 {
+		limit = DefaultHistogramColors
+	}
+	return &ColorHistogram{
+		bins:  make(map[uint32]uint64),
+		bits:  8,
+		limit: limit,
+	}
+}
+
+func (hist *ColorHistogram) key(color IntColor) uint32 {
+	shift := 8 - hist.bits
+	return uint32(color.R>>shift)<<16 | uint32(color.G>>shift)<<8 | uint32(color.B>>shift)
+}
+
+func (hist *ColorHistogram) Add(color IntColor) {
+	hist.bins[hist.key(color)]++
+	if len(hist.bins) > hist.limit && hist.bits > minHistogramBits {
+		hist.reduce()
+	}
+}
+
+// Drops one bit of precision per channel, merging neighbouring bins
+func (hist *ColorHistogram) reduce() {
+	hist.bits--
+	bins := make(map[uint32]uint64, len(hist.bins)/4)
+	for key, count := range hist.bins {
+		r := ((key >> 16) & 0xFF) >> 1
+		g := ((key >> 8) & 0xFF) >> 1
+		b := (key & 0xFF) >> 1
+		bins[r<<16|g<<8|b] += count
+	}
+	hist.bins = bins
+}
+
+func (hist *ColorHistogram) Len() int {
+	return len(hist.bins)
+}
+
+func (hist *ColorHistogram) Bits() int {
+	return hist.bits
+}
+
+// Points are placed in bin centers and sorted by color for reproducible results
+func (hist *ColorHistogram) Points() []ColorPoint {
+	keys := make([]uint32, 0, len(hist.bins))
+	for key := range hist.bins {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	shift := 8 - hist.bits
+	center := (1 << shift) / 2
+	result := make([]ColorPoint, len(keys))
+	for i, key := range keys {
+		r := int((key>>16)&0xFF)<<shift + center
+		g := int((key>>8)&0xFF)<<shift + center
+		b := int(key&0xFF)<<shift + center
+		result[i] = ColorPoint{
+			color:    FloatColor{float64(r) / 255, float64(g) / 255, float64(b) / 255},
+			segment:  0,
+			count:    hist.bins[key],
+			distance: math.MaxFloat64}
+	}
+	return result
+}
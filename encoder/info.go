@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type RVFAudioInfo struct {
+	Channels   int     `json:"channels"`
+	SampleRate uint    `json:"sample_rate"`
+	Codec      string  `json:"codec"`
+	BlockAlign int     `json:"block_align,omitempty"`
+	DataSize   int     `json:"data_size"`
+	Samples    int     `json:"samples"`
+	Duration   float64 `json:"duration"`
+}
+
+type RVFMetadataInfo struct {
+	Title string `json:"title"`
+}
+
+type RVFFrameInfo struct {
+	Index int      `json:"index"`
+	Size  int      `json:"size"`
+	Flags []string `json:"flags,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+type RVFOpcodeInfo struct {
+	Name   string `json:"name"`
+	Code   byte   `json:"code"`
+	Ops    int    `json:"ops"`
+	Blocks int    `json:"blocks"`
+	Bytes  int    `json:"bytes"`
+}
+
+type RVFInfo struct {
+	File        string           `json:"file"`
+	FileSize    int64            `json:"file_size"`
+	Version     int              `json:"version"`
+	Width       int              `json:"width"`
+	Height      int              `json:"height"`
+	FrameCount  int              `json:"frame_count"` // -1 if unknown
+	FrameTime   float32          `json:"frame_time"`
+	Duration    float64          `json:"duration"`
+	Flags       []string         `json:"flags"`
+	Audio       *RVFAudioInfo    `json:"audio,omitempty"`
+	Metadata    *RVFMetadataInfo `json:"metadata,omitempty"`
+	PaletteSize int              `json:"palette_size"`
+	IndexSize   int              `json:"index_size,omitempty"`
+	Frames      []RVFFrameInfo   `json:"frames"`
+	Opcodes     []RVFOpcodeInfo  `json:"opcodes,omitempty"`
+	Error       string           `json:"error,omitempty"`
+
+	HeaderCorrupted bool `json:"header_corrupted,omitempty"`
+}
+
+func headerFlagNames(flags uint8) []string {
+	result := []string{}
+	if flags&CompressionFull != 0 {
+		result = append(result, "compression_full")
+	} else {
+		result = append(result, "compression_none")
+	}
+	if flags&AudioBlock != 0 {
+		result = append(result, "audio_block")
+	}
+	if flags&AudioStream != 0 {
+		result = append(result, "audio_stream")
+	}
+	if flags&Checksums != 0 {
+		result = append(result, "checksums")
+	}
+	if flags&Index != 0 {
+		result = append(result, "index")
+	}
+	if flags&Metadata != 0 {
+		result = append(result, "metadata")
+	}
+	if unknown := flags &^ (CompressionFull | AudioBlock | AudioStream | Checksums | Index | Metadata); unknown != 0 {
+		result = append(result, fmt.Sprintf("unknown_0x%02x", unknown))
+	}
+	return result
+}
+
+func frameFlagNames(flags uint8) []string {
+	result := []string{}
+	if flags&FrameIsKeyframe != 0 {
+		result = append(result, "keyframe")
+	}
+	if flags&FrameIsFirst != 0 {
+		result = append(result, "first")
+	}
+	if flags&FrameIsLast != 0 {
+		result = append(result, "last")
+	}
+	if unknown := flags &^ (FrameIsKeyframe | FrameIsFirst | FrameIsLast); unknown != 0 {
+		result = append(result, fmt.Sprintf("unknown_0x%02x", unknown))
+	}
+	return result
+}
+
+// Reads the whole file, errors in frames are stored in the result
+func ReadRVFInfo(filename string) (*RVFInfo, error) {
+	rvf, err := OpenRVF(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rvf.Close()
+
+	header := rvf.Header
+	result := &RVFInfo{
+		File:        filename,
+		Version:     header.Version,
+		Width:       header.Width,
+		Height:      header.Height,
+		FrameCount:  header.Frames,
+		FrameTime:   header.FrameTime,
+		Duration:    float64(header.Frames) * float64(header.FrameTime),
+		Flags:       headerFlagNames(header.Flags),
+		PaletteSize: rvf.Palette.Len(),
+		IndexSize:   len(rvf.Index),
+		Frames:      []RVFFrameInfo{},
+
+		HeaderCorrupted: rvf.HeaderCorrupted,
+	}
+	if stat, err := os.Stat(filename); err == nil {
+		result.FileSize = stat.Size()
+	}
+	if header.Metadata != nil {
+		result.Metadata = &RVFMetadataInfo{Title: header.Metadata.Title}
+	}
+	if header.Audio != nil {
+		codec, ok := audioCodecNames[header.Audio.Codec]
+		if !ok {
+			codec = fmt.Sprintf("unknown_%d", header.Audio.Codec)
+		}
+		result.Audio = &RVFAudioInfo{
+			Channels:   header.Audio.Channels,
+			SampleRate: header.Audio.SampleRate,
+			Codec:      codec,
+			BlockAlign: header.Audio.BlockAlign,
+			DataSize:   len(rvf.AudioData),
+		}
+		if buffer, err := rvf.Audio(); err == nil && buffer != nil {
+			result.Audio.Samples = buffer.Len()
+			result.Audio.Duration = buffer.Duration()
+		}
+	}
+
+	compressed := header.Flags&CompressionFull != 0
+	opcodes := map[byte]*RVFOpcodeInfo{}
+	for index := 0; ; index++ {
+		frame, err := rvf.NextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("frame %d: %s", index, err)
+			break
+		}
+		info := RVFFrameInfo{Index: index, Size: len(frame.Data)}
+		if compressed {
+			info.Flags = frameFlagNames(frame.Flags)
+			_, err := ScanFrame(frame.Data, func(op FrameOp) {
+				stats, ok := opcodes[op.Code]
+				if !ok {
+					stats = &RVFOpcodeInfo{Name: opcodeNames[op.Code], Code: op.Code}
+					opcodes[op.Code] = stats
+				}
+				stats.Ops++
+				stats.Blocks += op.Count
+				stats.Bytes += op.Size
+			})
+			if frame.Corrupted {
+				info.Error = "checksum mismatch"
+			} else if err != nil {
+				info.Error = err.Error()
+			}
+		}
+		result.Frames = append(result.Frames, info)
+	}
+
+	if header.Frames < 0 {
+		result.Duration = float64(len(result.Frames)) * float64(header.FrameTime)
+	}
+	for _, stats := range opcodes {
+		result.Opcodes = append(result.Opcodes, *stats)
+	}
+	sort.Slice(result.Opcodes, func(i, j int) bool { return result.Opcodes[i].Code < result.Opcodes[j].Code })
+	return result, nil
+}
+
+func (info *RVFInfo) PrintJSON() {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+}
+
+func (info *RVFInfo) Print() {
+	fmt.Printf("File: %s (%d bytes)\n", info.File, info.FileSize)
+	fmt.Printf("Version: %d\n", info.Version)
+	fmt.Printf("Size: %dx%d\n", info.Width, info.Height)
+	if info.FrameCount < 0 {
+		fmt.Println("Frames: unknown")
+	} else {
+		fmt.Printf("Frames: %d\n", info.FrameCount)
+	}
+	if info.FrameTime > 0 {
+		fmt.Printf("Frame time: %f s (%.3f fps)\n", info.FrameTime, 1/info.FrameTime)
+	} else {
+		fmt.Printf("Frame time: %f s\n", info.FrameTime)
+	}
+	fmt.Printf("Duration: %.3f s\n", info.Duration)
+	fmt.Printf("Flags: %s\n", strings.Join(info.Flags, ", "))
+	if info.HeaderCorrupted {
+		fmt.Println("Header checksum mismatch")
+	}
+	if info.Metadata != nil {
+		fmt.Printf("Title: %q\n", info.Metadata.Title)
+	} else {
+		fmt.Println("Metadata: none")
+	}
+	fmt.Printf("Palette: %d colors\n", info.PaletteSize)
+	if info.IndexSize > 0 {
+		fmt.Printf("Index: %d frames\n", info.IndexSize)
+	}
+	if info.Audio != nil {
+		audio := info.Audio
+		fmt.Printf("Audio: %s, %d channels, %d Hz", audio.Codec, audio.Channels, audio.SampleRate)
+		if audio.BlockAlign > 0 {
+			fmt.Printf(", block %d bytes", audio.BlockAlign)
+		}
+		fmt.Printf(", %d bytes, %d samples, %.3f s\n", audio.DataSize, audio.Samples, audio.Duration)
+	} else {
+		fmt.Println("Audio: none")
+	}
+
+	fmt.Println("Frame list:")
+	total := 0
+	for _, frame := range info.Frames {
+		total += frame.Size
+		line := fmt.Sprintf("  %6d %8d bytes  %s", frame.Index, frame.Size, strings.Join(frame.Flags, " "))
+		if frame.Error != "" {
+			line += "  error: " + frame.Error
+		}
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	if len(info.Frames) > 0 {
+		fmt.Printf("Frame data: %d bytes, %d bytes per frame on average\n", total, total/len(info.Frames))
+	}
+	if info.FrameCount < 0 {
+		fmt.Printf("Frames in file: %d\n", len(info.Frames))
+	} else if len(info.Frames) != info.FrameCount {
+		fmt.Printf("Frames in file: %d (header: %d)\n", len(info.Frames), info.FrameCount)
+	}
+
+	if len(info.Opcodes) > 0 {
+		totalBlocks := 0
+		for _, stats := range info.Opcodes {
+			totalBlocks += stats.Blocks
+		}
+		fmt.Println("Opcodes:")
+		fmt.Printf("  %-15s %10s %10s %8s %12s\n", "", "ops", "blocks", "blocks%", "bytes")
+		for _, stats := range info.Opcodes {
+			fmt.Printf("  %-15s %10d %10d %7.1f%% %12d\n", stats.Name, stats.Ops, stats.Blocks, float64(stats.Blocks)/float64(totalBlocks)*100, stats.Bytes)
+		}
+	}
+	if info.Error != "" {
+		fmt.Printf("Error: %s\n", info.Error)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Color difference used by PalComp is a quadratic form:
+//   diff = 0.75 * (0.299*dR² + 0.587*dG² + 0.114*dB²) + (0.299*dR + 0.587*dG + 0.114*dB)²
+// so after the linear transform from its Cholesky decomposition it becomes plain squared euclidean distance,
+// and a k-d tree can be used to find the nearest palette color.
+
+// Tree is only used for pruning, final distances are computed by lumaDifference,
+// so lookup result is always the same as the exhaustive search (including ties).
+const kdPruneEpsilon = 1e-9
+
+type kdNode struct {
+	point int
+	axis  int
+	left  int
+	right int
+}
+
+type KDTree struct {
+	nodes  []kdNode
+	points [][3]float64
+	colors []FloatColor
+	lumas  []float64
+	root   int
+	basis  [3][3]float64
+}
+
+func diffMatrix() [3][3]float64 {
+	weights := [3]float64{0.299, 0.587, 0.114}
+	var result [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			result[i][j] = weights[i] * weights[j]
+		}
+		result[i][i] += 0.75 * weights[i]
+	}
+	return result
+}
+
+// Returns upper triangular U with U^T * U = m
+func choleskyUpper(m [3][3]float64) [3][3]float64 {
+	var lower [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j <= i; j++ {
+			sum := m[i][j]
+			for k := 0; k < j; k++ {
+				sum -= lower[i][k] * lower[j][k]
+			}
+			if i == j {
+				lower[i][j] = math.Sqrt(sum)
+			} else {
+				lower[i][j] = sum / lower[j][j]
+			}
+		}
+	}
+	var result [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			result[i][j] = lower[j][i]
+		}
+	}
+	return result
+}
+
+func (tree *KDTree) transform(color FloatColor) [3]float64 {
+	var result [3]float64
+	for i := 0; i < 3; i++ {
+		result[i] = tree.basis[i][0]*color.R + tree.basis[i][1]*color.G + tree.basis[i][2]*color.B
+	}
+	return result
+}
+
+func NewKDTree(colors []FloatColor) *KDTree {
+	tree := &KDTree{
+		nodes:  make([]kdNode, 0, len(colors)),
+		points: make([][3]float64, len(colors)),
+		colors: colors,
+		lumas:  make([]float64, len(colors)),
+		basis:  choleskyUpper(diffMatrix()),
+	}
+	indices := make([]int, len(colors))
+	for i, color := range colors {
+		tree.points[i] = tree.transform(color)
+		tree.lumas[i] = color.Luma()
+		indices[i] = i
+	}
+	tree.root = tree.build(indices)
+	return tree
+}
+
+func (tree *KDTree) build(indices []int) int {
+	if len(indices) == 0 {
+		return -1
+	}
+
+	axis := 0
+	maxSpread := -1.0
+	for a := 0; a < 3; a++ {
+		minVal := math.MaxFloat64
+		maxVal := -math.MaxFloat64
+		for _, i := range indices {
+			minVal = math.Min(minVal, tree.points[i][a])
+			maxVal = math.Max(maxVal, tree.points[i][a])
+		}
+		if maxVal-minVal > maxSpread {
+			maxSpread = maxVal - minVal
+			axis = a
+		}
+	}
+
+	sort.Slice(indices, func(i, j int) bool { return tree.points[indices[i]][axis] < tree.points[indices[j]][axis] })
+	median := len(indices) / 2
+
+	nodeIndex := len(tree.nodes)
+	tree.nodes = append(tree.nodes, kdNode{point: indices[median], axis: axis})
+	left := tree.build(indices[:median])
+	right := tree.build(indices[median+1:])
+	tree.nodes[nodeIndex].left = left
+	tree.nodes[nodeIndex].right = right
+	return nodeIndex
+}
+
+type kdSearch struct {
+	query     [3]float64
+	color     FloatColor
+	luma      float64
+	bestIndex int
+	bestDist  float64
+}
+
+func (tree *KDTree) search(node int, state *kdSearch) {
+	if node < 0 {
+		return
+	}
+	n := &tree.nodes[node]
+
+	dist := lumaDifference(state.color, state.luma, tree.colors[n.point], tree.lumas[n.point])
+	if dist < state.bestDist || (dist == state.bestDist && n.point < state.bestIndex) {
+		state.bestDist = dist
+		state.bestIndex = n.point
+	}
+
+	delta := state.query[n.axis] - tree.points[n.point][n.axis]
+	near, far := n.left, n.right
+	if delta > 0 {
+		near, far = far, near
+	}
+	tree.search(near, state)
+	if delta*delta <= state.bestDist*(1+kdPruneEpsilon)+kdPruneEpsilon {
+		tree.search(far, state)
+	}
+}
+
+// Returns index of the nearest color, the lowest one on ties
+func (tree *KDTree) Nearest(color FloatColor) int {
+	state := kdSearch{
+		query:     tree.transform(color),
+		color:     color,
+		luma:      color.Luma(),
+		bestIndex: 0,
+		bestDist:  math.MaxFloat64,
+	}
+	tree.search(tree.root, &state)
+	return state.bestIndex
+}
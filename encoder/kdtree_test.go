@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomPalette(rnd *rand.Rand, size int, levels int) Palette {
+	pal := make(Palette, size)
+	for i := range pal {
+		if levels > 0 && rnd.Intn(4) == 0 && i > 0 {
+			// Duplicate entry
+			pal[i] = pal[rnd.Intn(i)]
+			continue
+		}
+		if levels > 0 {
+			step := 255 / (levels - 1)
+			pal[i] = IntColor{rnd.Intn(levels) * step, rnd.Intn(levels) * step, rnd.Intn(levels) * step}
+		} else {
+			pal[i] = IntColor{rnd.Intn(256), rnd.Intn(256), rnd.Intn(256)}
+		}
+	}
+	return pal
+}
+
+// Random colors, palette colors and midpoints between them (ties)
+func testColors(rnd *rand.Rand, pc *PalComp, count int) []FloatColor {
+	colors := make([]FloatColor, 0, count)
+	for len(colors) < count {
+		switch rnd.Intn(3) {
+		case 0:
+			colors = append(colors, FloatColor{rnd.Float64(), rnd.Float64(), rnd.Float64()})
+		case 1:
+			colors = append(colors, pc.ToFloatColor(rnd.Intn(pc.pal.Len())))
+		case 2:
+			a := pc.ToFloatColor(rnd.Intn(pc.pal.Len()))
+			b := pc.ToFloatColor(rnd.Intn(pc.pal.Len()))
+			colors = append(colors, FloatColor{(a.R + b.R) / 2, (a.G + b.G) / 2, (a.B + b.B) / 2})
+		}
+	}
+	return colors
+}
+
+func TestKDTreeMatchesLinear(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 300; n++ {
+		size := 1 + rnd.Intn(256)
+		levels := []int{0, 2, 3, 5}[n%4]
+		pal := randomPalette(rnd, size, levels)
+		for _, pc := range []*PalComp{NewPalComp(pal), NewLinearPalComp(pal)} {
+			for _, color := range testColors(rnd, pc, 500) {
+				expected := pc.GetColorIndexLinear(color)
+				if got := pc.GetColorIndex(color); got != expected {
+					t.Fatalf("palette %d (%d colors, linear %v): color %v, k-d tree %d, exhaustive %d",
+						n, size, pc.linear, color, got, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestPaletteLookup(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for n := 0; n < 100; n++ {
+		pal := randomPalette(rnd, 1+rnd.Intn(256), []int{0, 3}[n%2])
+		lookup := pal.Lookup()
+		for i := 0; i < 200; i++ {
+			color := FloatColor{rnd.Float64(), rnd.Float64(), rnd.Float64()}
+			if i%2 == 0 {
+				color = pal[rnd.Intn(pal.Len())].ToFloatColor()
+			}
+			expected := pal.GetFloatColorIndex(color)
+			if got := lookup.Nearest(color); got != expected {
+				t.Fatalf("palette %d: color %v, k-d tree %d, exhaustive %d", n, color, got, expected)
+			}
+		}
+	}
+}
+
+func benchmarkLookup(b *testing.B, linear bool) {
+	rnd := rand.New(rand.NewSource(3))
+	pc := NewPalComp(randomPalette(rnd, 256, 0))
+	colors := make([]FloatColor, 4096)
+	for i := range colors {
+		colors[i] = FloatColor{rnd.Float64(), rnd.Float64(), rnd.Float64()}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if linear {
+			pc.GetColorIndexLinear(colors[i%len(colors)])
+		} else {
+			pc.GetColorIndex(colors[i%len(colors)])
+		}
+	}
+}
+
+func BenchmarkLookupKDTree(b *testing.B) {
+	benchmarkLookup(b, false)
+}
+
+func BenchmarkLookupLinear(b *testing.B) {
+	benchmarkLookup(b, true)
+}
+
+func benchmarkDithering(b *testing.B, method string, exhaustive bool) {
+	const width, height = 320, 240
+	rnd := rand.New(rand.NewSource(4))
+	pal := randomPalette(rnd, 256, 0)
+	frame := make([]IntColor, width*height)
+	for i := range frame {
+		frame[i] = IntColor{(i % width) * 255 / width, (i / width) * 255 / height, rnd.Intn(256)}
+	}
+	dithering, err := FindDithering(method)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pc := NewPalComp(pal)
+	pc.exhaustive = exhaustive
+	dithering.Init(pal, pc, width, height)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dithering.Process(frame, pal)
+	}
+}
+
+func BenchmarkDitheringNoneKDTree(b *testing.B) {
+	benchmarkDithering(b, "none", false)
+}
+
+func BenchmarkDitheringNoneLinear(b *testing.B) {
+	benchmarkDithering(b, "none", true)
+}
+
+func BenchmarkDitheringFSKDTree(b *testing.B) {
+	benchmarkDithering(b, "fs", false)
+}
+
+func BenchmarkDitheringFSLinear(b *testing.B) {
+	benchmarkDithering(b, "fs", true)
+}
+
+// Pattern dithering looks up order colors for every pixel
+func BenchmarkDitheringPat4KDTree(b *testing.B) {
+	benchmarkDithering(b, "pat4", false)
+}
+
+func BenchmarkDitheringPat4Linear(b *testing.B) {
+	benchmarkDithering(b, "pat4", true)
+}
+
+func BenchmarkDitheringPat8KDTree(b *testing.B) {
+	benchmarkDithering(b, "pat8", false)
+}
+
+func BenchmarkDitheringPat8Linear(b *testing.B) {
+	benchmarkDithering(b, "pat8", true)
+}
@@ -0,0 +1,93 @@
+package main
+
+type KernelEntry struct {
+	DX     int
+	DY     int
+	Weight float64
+}
+
+type DiffusionKernel struct {
+	Divisor float64
+	Entries []KernelEntry
+}
+
+var kernelFloydSteinberg = &DiffusionKernel{
+	Divisor: 16,
+	Entries: []KernelEntry{
+		{1, 0, 7},
+		{-1, 1, 3}, {0, 1, 5}, {1, 1, 1},
+	},
+}
+
+// Diffuses only 6/8 of the error
+var kernelAtkinson = &DiffusionKernel{
+	Divisor: 8,
+	Entries: []KernelEntry{
+		{1, 0, 1}, {2, 0, 1},
+		{-1, 1, 1}, {0, 1, 1}, {1, 1, 1},
+		{0, 2, 1},
+	},
+}
+
+var kernelJarvisJudiceNinke = &DiffusionKernel{
+	Divisor: 48,
+	Entries: []KernelEntry{
+		{1, 0, 7}, {2, 0, 5},
+		{-2, 1, 3}, {-1, 1, 5}, {0, 1, 7}, {1, 1, 5}, {2, 1, 3},
+		{-2, 2, 1}, {-1, 2, 3}, {0, 2, 5}, {1, 2, 3}, {2, 2, 1},
+	},
+}
+
+var kernelStucki = &DiffusionKernel{
+	Divisor: 42,
+	Entries: []KernelEntry{
+		{1, 0, 8}, {2, 0, 4},
+		{-2, 1, 2}, {-1, 1, 4}, {0, 1, 8}, {1, 1, 4}, {2, 1, 2},
+		{-2, 2, 1}, {-1, 2, 2}, {0, 2, 4}, {1, 2, 2}, {2, 2, 1},
+	},
+}
+
+var kernelBurkes = &DiffusionKernel{
+	Divisor: 32,
+	Entries: []KernelEntry{
+		{1, 0, 8}, {2, 0, 4},
+		{-2, 1, 2}, {-1, 1, 4}, {0, 1, 8}, {1, 1, 4}, {2, 1, 2},
+	},
+}
+
+var kernelSierra3 = &DiffusionKernel{
+	Divisor: 32,
+	Entries: []KernelEntry{
+		{1, 0, 5}, {2, 0, 3},
+		{-2, 1, 2}, {-1, 1, 4}, {0, 1, 5}, {1, 1, 4}, {2, 1, 2},
+		{-1, 2, 2}, {0, 2, 3}, {1, 2, 2},
+	},
+}
+
+var kernelSierra2 = &DiffusionKernel{
+	Divisor: 16,
+	Entries: []KernelEntry{
+		{1, 0, 4}, {2, 0, 3},
+		{-2, 1, 1}, {-1, 1, 2}, {0, 1, 3}, {1, 1, 2}, {2, 1, 1},
+	},
+}
+
+var kernelSierraLite = &DiffusionKernel{
+	Divisor: 4,
+	Entries: []KernelEntry{
+		{1, 0, 2},
+		{-1, 1, 1}, {0, 1, 1},
+	},
+}
+
+var diffusionKernels = map[string]*DiffusionKernel{
+	"fs":         kernelFloydSteinberg,
+	"atkinson":   kernelAtkinson,
+	"jjn":        kernelJarvisJudiceNinke,
+	"stucki":     kernelStucki,
+	"burkes":     kernelBurkes,
+	"sierra":     kernelSierra3,
+	"sierra3":    kernelSierra3,
+	"sierra2":    kernelSierra2,
+	"sierralite": kernelSierraLite,
+}
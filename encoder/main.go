@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -58,6 +59,14 @@ func main() {
 		return
 	}
 
+	// Set by commands that must fail without panic, applied after all deferred calls
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	fc, err := os.Create("profiling/cpuprof.profile")
 	if err != nil {
 		log.Fatal("could not create CPU profile: ", err)
@@ -69,48 +78,126 @@ func main() {
 	defer pprof.StopCPUProfile()
 
 	command := os.Args[1]
+	arguments := os.Args[2:]
+	subcommand := ""
+	if len(arguments) > 0 && isSubcommand(command, arguments[0]) {
+		subcommand = arguments[0]
+		arguments = arguments[1:]
+	}
 
 	flags := flag.NewFlagSet("", flag.ExitOnError)
 	var (
-		argOutput      string
-		argPalFrom     string
-		argPalSave     string
-		argFrameRate   float64
-		argDithering   string
-		argCompression int
-		argAudio       string
+		argOutput        string
+		argPalFrom       string
+		argPalSave       string
+		argFrameRate     float64
+		argDithering     string
+		argCompression   int
+		argAudio         string
+		argFormat        string
+		argLock          string
+		argFrameStep     int
+		argPixelStep     int
+		argMaxColors     int
+		argSize          string
+		argOrder         int
+		argSeed          int64
+		argFit           string
+		argFilter        string
+		argPixelAspect   string
+		argInputRate     float64
+		argBlend         bool
+		argAudioRate     int
+		argAudioChannels int
+		argAudioBits     int
+		argAudioCodec    string
+		argAudioOffset   float64
+		argSync          string
+		argSyncTolerance float64
+		argAudioRaw      string
+		argJSON          bool
+		argChecksums     bool
+		argKeyframes     int
+		argDedupe        bool
+		argTitle         string
 	)
 
-	flags.StringVar(&argOutput, "o", "", "output file")
-	flags.StringVar(&argOutput, "output", "", "output file")
+	flags.StringVar(&argOutput, "o", "", "output file (- for standard output when encoding)")
+	flags.StringVar(&argOutput, "output", "", "output file (- for standard output when encoding)")
 	flags.StringVar(&argPalFrom, "pf", "", "loading palette file")
 	flags.StringVar(&argPalFrom, "pal-from", "", "loading palette file")
 	flags.StringVar(&argPalSave, "ps", "", "saving palette file")
 	flags.StringVar(&argPalSave, "pal-save", "", "saving palette file")
 	flags.Float64Var(&argFrameRate, "fr", 30.0, "video frame rate")
 	flags.Float64Var(&argFrameRate, "frame-rate", 30.0, "video frame rate")
-	flags.StringVar(&argDithering, "d", "none", "dithering method")
-	flags.StringVar(&argDithering, "dithering", "none", "dithering method")
+	flags.Float64Var(&argInputRate, "ir", 0, "input frame rate (default from input)")
+	flags.Float64Var(&argInputRate, "input-rate", 0, "input frame rate (default from input)")
+	flags.BoolVar(&argBlend, "blend", false, "blend frames when converting frame rate")
+	flags.StringVar(&argDithering, "d", "none", "dithering method (name[:param=value,flag,...])")
+	flags.StringVar(&argDithering, "dithering", "none", "dithering method (name[:param=value,flag,...])")
 	flags.IntVar(&argCompression, "c", 0, "compression level")
 	flags.IntVar(&argCompression, "compression", 0, "compression level")
-	flags.StringVar(&argAudio, "audio", "", "compression level")
-	flags.StringVar(&argAudio, "a", "", "compression level")
-
-	flags.Parse(os.Args[2:])
+	flags.StringVar(&argAudio, "audio", "", "audio file (WAV, AIFF or raw PCM)")
+	flags.StringVar(&argAudio, "a", "", "audio file (WAV, AIFF or raw PCM)")
+	flags.StringVar(&argAudioRaw, "audio-raw", "", "raw PCM audio format (rate,channels,bits; bits suffixes: u, be, f)")
+	flags.IntVar(&argAudioRate, "ar", 0, "audio sample rate (default from input)")
+	flags.IntVar(&argAudioRate, "audio-rate", 0, "audio sample rate (default from input)")
+	flags.IntVar(&argAudioChannels, "ac", 0, "audio channels, 1 or 2 (default from input)")
+	flags.IntVar(&argAudioChannels, "audio-channels", 0, "audio channels, 1 or 2 (default from input)")
+	flags.IntVar(&argAudioBits, "ab", 0, "audio bit depth, 8 or 16 (default from input)")
+	flags.IntVar(&argAudioBits, "audio-bits", 0, "audio bit depth, 8 or 16 (default from input)")
+	flags.StringVar(&argAudioCodec, "acodec", "pcm", "audio codec (pcm, adpcm)")
+	flags.StringVar(&argAudioCodec, "audio-codec", "pcm", "audio codec (pcm, adpcm)")
+	flags.Float64Var(&argAudioOffset, "ao", 0, "audio offset in seconds, positive delays audio")
+	flags.Float64Var(&argAudioOffset, "audio-offset", 0, "audio offset in seconds, positive delays audio")
+	flags.StringVar(&argSync, "sync", "none", "audio/video duration sync (none, trim, pad, hold)")
+	flags.Float64Var(&argSyncTolerance, "sync-tolerance", 0.1, "allowed audio/video duration difference in seconds")
+	flags.StringVar(&argFormat, "f", "", "output file format")
+	flags.StringVar(&argFormat, "format", "", "output file format")
+	flags.StringVar(&argLock, "l", "", "locked palette colors (index=RRGGBB,...)")
+	flags.StringVar(&argLock, "lock", "", "locked palette colors (index=RRGGBB,...)")
+	flags.IntVar(&argFrameStep, "sf", 1, "use every Nth frame for palette")
+	flags.IntVar(&argFrameStep, "sample-frames", 1, "use every Nth frame for palette")
+	flags.IntVar(&argPixelStep, "sp", 1, "use every Nth pixel for palette")
+	flags.IntVar(&argPixelStep, "sample-pixels", 1, "use every Nth pixel for palette")
+	flags.IntVar(&argMaxColors, "max-colors", DefaultHistogramColors, "maximum number of distinct colors in palette histogram")
+	flags.StringVar(&argSize, "size", "", "size (WxH)")
+	flags.IntVar(&argOrder, "order", 64, "number of pattern levels")
+	flags.Int64Var(&argSeed, "seed", 1, "random seed")
+	flags.StringVar(&argFit, "fit", "letterbox", "fitting frames into size (letterbox, crop, stretch)")
+	flags.StringVar(&argFilter, "filter", "bilinear", "resize filter (nearest, bilinear, lanczos)")
+	flags.StringVar(&argPixelAspect, "pixel-aspect", "1:1", "output pixel aspect ratio (W:H)")
+	flags.BoolVar(&argJSON, "json", false, "print information as JSON")
+	flags.BoolVar(&argDedupe, "dedupe", false, "drop repeated colors when converting palette")
+	flags.BoolVar(&argChecksums, "crc", false, "add CRC32 checksums of frames (compressed files only)")
+	flags.BoolVar(&argChecksums, "checksums", false, "add CRC32 checksums of frames (compressed files only)")
+	flags.IntVar(&argKeyframes, "ki", 0, "force keyframe every N frames for error recovery (0 - only when possible)")
+	flags.IntVar(&argKeyframes, "keyframe-interval", 0, "force keyframe every N frames for error recovery (0 - only when possible)")
+	flags.StringVar(&argTitle, "t", "", "video title stored in metadata")
+	flags.StringVar(&argTitle, "title", "", "video title stored in metadata")
+
+	flags.Parse(arguments)
 	argInput := flags.Args()
-	if len(argInput) < 1 {
+	if len(argInput) < 1 && needsInput(command, subcommand) {
 		fmt.Println("Usage: rvc <command> <arguments> <input>")
 		return
 	}
 	argInputString := strings.Join(argInput, " ")
 
-	termInit()
-	defer termReset()
-	termSetTitle("Retro Video Codec")
+	// Video goes to standard output, messages to standard error
+	if argOutput == "-" {
+		os.Stdout = os.Stderr
+	}
+
+	// Machine-readable output goes without the banner
+	if !argJSON {
+		termInit()
+		defer termReset()
+		termSetTitle("Retro Video Codec")
 
-	termSetColor(TermBlue)
+		termSetColor(TermBlue)
 
-	fmt.Println(`
+		fmt.Println(`
     8888888b.   888     888   .d8888b.
     888   Y88b  888     888  d88P  Y88b
     888    888  888     888  888    888
@@ -122,43 +209,145 @@ func main() {
 
     R E T R O    V I D E O    C O D E C
  `)
-	termSetColor(TermReset)
-
-	fmt.Printf("Command: %s\n", command)
-	fmt.Printf("Input: \"%s\"\n", argInputString)
-	fmt.Printf("Output: %s\n", argOutput)
-	fmt.Printf("Input palette: %s\n", argPalFrom)
-	fmt.Printf("Output palette: %s\n", argPalSave)
-	fmt.Printf("Frame rate: %f\n", argFrameRate)
-	fmt.Printf("Ditherig: %s\n", argDithering)
-	fmt.Printf("Compression level: %d\n", argCompression)
-	fmt.Printf("Audio: %s\n", argAudio)
+		termSetColor(TermReset)
+
+		if subcommand != "" {
+			fmt.Printf("Command: %s %s\n", command, subcommand)
+		} else {
+			fmt.Printf("Command: %s\n", command)
+		}
+		fmt.Printf("Input: \"%s\"\n", argInputString)
+		fmt.Printf("Output: %s\n", argOutput)
+		fmt.Printf("Input palette: %s\n", argPalFrom)
+		fmt.Printf("Output palette: %s\n", argPalSave)
+		fmt.Printf("Frame rate: %f\n", argFrameRate)
+		fmt.Printf("Ditherig: %s\n", argDithering)
+		fmt.Printf("Compression level: %d\n", argCompression)
+		fmt.Printf("Audio: %s\n", argAudio)
+	}
 
 	switch command {
 	case "palette":
-		if argOutput == "" {
+		if subcommand == "convert" {
+			if argOutput == "" {
+				fmt.Println("Must specify output filename (-o, --output)")
+			} else {
+				if err := ConvertPalette(argInputString, argOutput, argFormat, argDedupe); err != nil {
+					fmt.Println(err)
+					exitCode = 1
+				}
+			}
+		} else if argOutput == "" {
 			fmt.Println("Must specify output filename (-o, --output)")
 		} else {
 			files := listFiles(argInputString)
-			if len(files) == 0 {
+			locked, err := ParseLockedColors(argLock)
+			if err != nil {
+				fmt.Println(err)
+			} else if len(files) == 0 {
 				fmt.Println("Can't find any files")
 			} else {
-				pal := CalcPalette(files)
-				pal.Save(argOutput)
+				pal, err := CalcPalette(files, locked, ColorSampling{
+					FrameStep: argFrameStep,
+					PixelStep: argPixelStep,
+					MaxColors: argMaxColors,
+				})
+				if err == nil {
+					// Already sorted, Save would move locked colors
+					err = pal.SaveAs(argOutput, paletteFormatByExt(argOutput))
+				}
+				if err != nil {
+					fmt.Println(err)
+					exitCode = 1
+				}
 			}
 		}
 	case "encode":
+		dithering, err := FindDithering(argDithering)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		if argPalFrom == "" {
+			fmt.Println("Must specify palette filename (-pf, --pal-from)")
+			exitCode = 1
+			break
+		}
+		palette, err := LoadPalette(argPalFrom)
+		if err != nil {
+			fmt.Println(err)
+			exitCode = 1
+			break
+		}
+		source, err := OpenFrameSource(argInputString, argFrameRate)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		// Frame rate of the source is used unless set explicitly, otherwise source is converted
+		inputRate := source.FrameRate()
+		if argInputRate > 0 {
+			inputRate = argInputRate
+		}
+		if !isFlagSet(flags, "fr", "frame-rate") && inputRate > 0 {
+			argFrameRate = inputRate
+			fmt.Printf("Frame rate (from input): %f\n", argFrameRate)
+		} else if inputRate > 0 && inputRate != argFrameRate {
+			source = NewRateConverter(source, inputRate, argFrameRate, argBlend)
+			fmt.Printf("Frame rate conversion: %f -> %f\n", inputRate, argFrameRate)
+		}
+		defer source.Close()
+		resizer, err := newResizer(source, argSize, argFit, argFilter, argPixelAspect)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
 		var audioFile *WAVfile = nil
 		if argAudio != "" {
-			audioFile = OpenWAV(argAudio)
+			settings := AudioSettings{
+				SampleRate: uint(argAudioRate),
+				Channels:   argAudioChannels,
+				Bits:       argAudioBits,
+				Codec:      argAudioCodec,
+			}
+			if err = settings.Validate(); err != nil {
+				fmt.Println(err)
+				break
+			}
+			policy, err := FindSyncPolicy(argSync)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			buffer, err := OpenAudio(argAudio, argAudioRaw)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			source, buffer = SyncAudioVideo(source, buffer.Shift(argAudioOffset), argFrameRate, policy, argSyncTolerance)
+			audioFile = ConvertAudio(buffer, settings)
+		}
+		if len(argTitle) > 255 {
+			fmt.Println("Title must be up to 255 bytes (-t, --title)")
+			break
+		}
+		var metadata *RVFMetadata
+		if argTitle != "" {
+			metadata = &RVFMetadata{Title: argTitle}
 		}
 		if argCompression == 0 {
-			RawEncode(argOutput,
-				PaletteLoad(argPalFrom),
-				listFiles(argInputString),
+			if argChecksums {
+				fmt.Println("Checksums are only supported in compressed files (-c, --compression)")
+				break
+			}
+			err = RawEncode(argOutput,
+				palette,
+				source,
+				resizer,
 				float32(argFrameRate),
-				FindDithering(argDithering),
-				audioFile)
+				dithering,
+				audioFile,
+				metadata)
 		} else {
 			comp := argCompression
 			if comp < 0 {
@@ -168,13 +357,21 @@ func main() {
 				comp = len(compressionLevels) - 1
 			}
 
-			Encode(argOutput,
-				PaletteLoad(argPalFrom),
-				listFiles(argInputString),
+			err = Encode(argOutput,
+				palette,
+				source,
+				resizer,
 				float32(argFrameRate),
-				FindDithering(argDithering),
+				dithering,
 				compressionLevels[comp], //0.02
-				audioFile)
+				audioFile,
+				argChecksums,
+				argKeyframes,
+				metadata)
+		}
+		if err != nil {
+			fmt.Println(err)
+			exitCode = 1
 		}
 	case "preview":
 		if argPalFrom == "" {
@@ -184,15 +381,66 @@ func main() {
 			if len(files) == 0 {
 				fmt.Println("Can't find any files")
 			} else {
-				dithering := FindDithering(argDithering)
-				if dithering == nil {
-					fmt.Println("Wrong dithering method")
+				dithering, err := FindDithering(argDithering)
+				if err != nil {
+					fmt.Println(err)
 				} else {
 					pal := PaletteLoad(argPalFrom)
 					Preview(files, pal, dithering)
 				}
 			}
 		}
+	case "info":
+		info, err := ReadRVFInfo(argInputString)
+		if err != nil {
+			fmt.Println(err)
+		} else if argJSON {
+			info.PrintJSON()
+		} else {
+			info.Print()
+		}
+	case "verify":
+		issues, err := VerifyRVF(argInputString)
+		if err != nil {
+			fmt.Println(err)
+			exitCode = 1
+			break
+		}
+		errors := 0
+		for _, issue := range issues {
+			fmt.Println(issue)
+			if !issue.Warning {
+				errors++
+			}
+		}
+		if stats, err := DecodeRVFStats(argInputString); err == nil && stats.Concealed > 0 {
+			fmt.Printf("Decoding: %s\n", stats)
+		}
+		if errors > 0 {
+			fmt.Printf("%d errors, %d warnings\n", errors, len(issues)-errors)
+			exitCode = 1
+		} else {
+			fmt.Printf("OK, %d warnings\n", len(issues))
+		}
+	case "pattern":
+		if subcommand != "generate" {
+			fmt.Println("Usage: rvc pattern generate --size WxH [--order N] [--seed N] -o <output>")
+		} else if argOutput == "" {
+			fmt.Println("Must specify output filename (-o, --output)")
+		} else {
+			width, height, err := parseSize(argSize)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				pattern, err := GenerateBlueNoise(width, height, argOrder, argSeed)
+				if err == nil {
+					err = pattern.Save(argOutput)
+				}
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
 	default:
 		fmt.Printf("Unknown command \"%s\"\n", command)
 	}
@@ -209,56 +457,126 @@ func main() {
 
 }
 
-func RawEncode(filename string, palette Palette, files []string, frameRate float32, dithering DitheringMethod, audio *WAVfile) {
-	if len(files) == 0 {
-		return
+func isSubcommand(command string, name string) bool {
+	switch command {
+	case "palette":
+		return name == "convert"
+	case "pattern":
+		return name == "generate"
+	default:
+		return false
 	}
+}
 
-	bar := progressbar.NewOptions(len(files),
+func isFlagSet(flags *flag.FlagSet, names ...string) bool {
+	result := false
+	flags.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				result = true
+			}
+		}
+	})
+	return result
+}
+
+func needsInput(command string, subcommand string) bool {
+	return command != "pattern"
+}
+
+func parseSize(size string) (int, int, error) {
+	var width, height int
+	if _, err := fmt.Sscanf(strings.ToLower(size), "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("wrong size \"%s\" (must be WxH)", size)
+	}
+	return width, height, nil
+}
+
+// Output size is the size of the first frame unless set explicitly
+func newResizer(source FrameSource, size string, fit string, filter string, pixelAspect string) (*FrameResizer, error) {
+	width, height := source.Size()
+	if size != "" {
+		var err error
+		if width, height, err = parseSize(size); err != nil {
+			return nil, err
+		}
+	}
+	fitMode, err := FindFitMode(fit)
+	if err != nil {
+		return nil, err
+	}
+	resizeFilter, err := FindResizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	aspect, err := ParsePixelAspect(pixelAspect)
+	if err != nil {
+		return nil, err
+	}
+	return NewFrameResizer(width, height, fitMode, resizeFilter, aspect), nil
+}
+
+func RawEncode(filename string, palette Palette, source FrameSource, resizer *FrameResizer, frameRate float32, dithering DitheringMethod, audio *WAVfile, metadata *RVFMetadata) error {
+	bar := progressbar.NewOptions(source.FrameCount(),
 		progressbar.OptionFullWidth(),
 		progressbar.OptionShowCount(),
 		progressbar.OptionUseANSICodes(true))
 
-	_, width, height, err := ImageLoad(files[0])
-	if err != nil {
-		panic(err)
-	}
+	width, height := resizer.Size()
 
 	palComp := NewPalComp(palette)
 
 	dithering.Init(palette, palComp, width, height)
 
-	rvf := NewRVFfile(filename, palette, width, height, len(files), frameRate, CompressionNone, audio)
-	defer rvf.Close()
+	rvf, err := NewRVFfile(filename, palette, width, height, frameRate, CompressionNone, audio, metadata)
+	if err != nil {
+		return err
+	}
 
 	bar.Set(0)
 
-	for i, file := range files {
-		imageColorData, fwidth, fheight, err := ImageLoad(file)
-		if err != nil {
-			panic(err)
+	frames := 0
+	for {
+		frame, err := source.Next()
+		if err == io.EOF {
+			break
 		}
-		if fwidth != width || fheight != height {
-			panic(fmt.Errorf("frame size incorrect (%dx%d  must be %dx%d)", fwidth, fheight, width, height))
+		if err != nil {
+			// Message goes after the progress bar
+			fmt.Println()
+			rvf.Close()
+			return err
 		}
-		imageIndexData := dithering.Process(imageColorData, palette)
+		imageIndexData := dithering.Process(resizer.Resize(frame).Data, palette)
 		rvf.WriteRaw(imageIndexData)
-		bar.Set(i + 1)
+		frames++
+		bar.Set(frames)
 	}
 
 	bar.Finish()
+	return rvf.Close()
 }
 
-func mtLoadImages(files []string, width int, height int, imchan chan []IntColor) {
-	for _, file := range files {
-		imageColorData, fwidth, fheight, err := ImageLoad(file)
-		if err != nil {
-			panic(err)
+// Source error is sent to errchan, it is closed after the last frame
+func mtLoadImages(source FrameSource, frchan chan Frame, errchan chan error) {
+	for {
+		frame, err := source.Next()
+		if err == io.EOF {
+			break
 		}
-		if fwidth != width || fheight != height {
-			panic(fmt.Errorf("frame size incorrect (%dx%d  must be %dx%d)", fwidth, fheight, width, height))
+		if err != nil {
+			errchan <- err
+			break
 		}
-		imchan <- imageColorData
+		frchan <- frame
+	}
+	close(errchan)
+	close(frchan)
+}
+
+func mtResizeImages(resizer *FrameResizer, frchan chan Frame, imchan chan []IntColor) {
+	for frame := range frchan {
+		imchan <- resizer.Resize(frame).Data
 	}
 	close(imchan)
 }
@@ -273,12 +591,8 @@ func mtDitherImages(dithering DitheringMethod, pal Palette, width int, height in
 	close(blchan)
 }
 
-func Encode(filename string, palette Palette, files []string, frameRate float32, dithering DitheringMethod, treshold float64, audio *WAVfile) {
-	if len(files) == 0 {
-		return
-	}
-
-	bar := progressbar.NewOptions(len(files),
+func Encode(filename string, palette Palette, source FrameSource, resizer *FrameResizer, frameRate float32, dithering DitheringMethod, treshold float64, audio *WAVfile, checksums bool, keyframeInterval int, metadata *RVFMetadata) error {
+	bar := progressbar.NewOptions(source.FrameCount(),
 		progressbar.OptionFullWidth(),
 		progressbar.OptionShowCount(),
 		progressbar.OptionUseANSICodes(true),
@@ -289,17 +603,20 @@ func Encode(filename string, palette Palette, files []string, frameRate float32,
 
 	bar.Set(0)
 
-	_, width, height, err := ImageLoad(files[0])
-	if err != nil {
-		panic(err)
-	}
+	width, height := resizer.Size()
 
 	palComp := NewPalComp(palette)
 
 	dithering.Init(palette, palComp, width, height)
 
-	rvf := NewRVFfile(filename, palette, width, height, len(files), frameRate, CompressionFull, audio)
-	defer rvf.Close()
+	flags := CompressionFull
+	if checksums {
+		flags |= Checksums
+	}
+	rvf, err := NewRVFfile(filename, palette, width, height, frameRate, flags, audio, metadata)
+	if err != nil {
+		return err
+	}
 
 	bw := int(math.Ceil(float64(width) / 4))
 	bh := int(math.Ceil(float64(height) / 4))
@@ -309,36 +626,63 @@ func Encode(filename string, palette Palette, files []string, frameRate float32,
 
 	totalSize := uint64(0)
 
-	imchan := make(chan []IntColor, 10)   //len(files)
-	blchan := make(chan []ImageBlock, 10) //len(files)
+	frchan := make(chan Frame, 10)
+	imchan := make(chan []IntColor, 10)
+	blchan := make(chan []ImageBlock, 10)
+	errchan := make(chan error, 1)
 
-	go mtLoadImages(files, width, height, imchan)
+	go mtLoadImages(source, frchan, errchan)
+	go mtResizeImages(resizer, frchan, imchan)
 	go mtDitherImages(dithering, palette, width, height, curve, imchan, blchan)
 
+	// Frame is written when the next one is ready, so the last one can be marked without knowing frame count
+	var pending []byte
+	pendingFlags := FrameRegular
 	ind := 0
 	for hblocks := range blchan {
+		if keyframeInterval > 0 && ind%keyframeInterval == 0 {
+			encoder.ForceKeyframe()
+		}
 		encoder.Encode(hblocks)
 		packdata := encoder.Pack()
 		flags := FrameRegular
 		if ind == 0 {
 			flags |= FrameIsFirst
 		}
-		if ind == len(files)-1 {
-			flags |= FrameIsLast
-		}
 		if encoder.IsClean() {
 			flags |= FrameIsKeyframe
 		}
-		rvf.WriteCompressed(packdata, flags)
+		if pending != nil {
+			rvf.WriteCompressed(pending, pendingFlags)
+		}
+		pending, pendingFlags = packdata, flags
 		totalSize += uint64(len(packdata))
 
 		bar.Set(ind + 1)
 		ind++
 	}
+	if err, failed := <-errchan; failed {
+		fmt.Println()
+		rvf.Close()
+		return err
+	}
+	if pending != nil {
+		rvf.WriteCompressed(pending, pendingFlags|FrameIsLast)
+	}
+	if err := rvf.Close(); err != nil {
+		return err
+	}
 
-	compression := float64(totalSize) / float64(width*height*len(files)) * 100
+	compression := 0.0
+	if ind > 0 {
+		compression = float64(totalSize) / float64(width*height*ind) * 100
+	}
 
 	bar.Finish()
 	fmt.Printf("\nCompression: %.f %%\nEncoding statistics:\n", compression)
 	encoder.PrintStats()
+	if stats, ok := dithering.(DitheringStats); ok {
+		stats.PrintStats(encoder.SkipRatio())
+	}
+	return nil
 }
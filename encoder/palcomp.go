@@ -7,44 +7,95 @@ type PalComp struct {
 	floatpal   []FloatColor
 	diffmatrix [][]float64
 	lumas      []float64
+	tree       *KDTree
+	linear     bool
+	exhaustive bool // GetColorIndex uses linear search, for benchmarks
 }
 
-func NewPalComp(pal Palette) *PalComp {
-	floatpal := make([]FloatColor, pal.Len())
-	lumas := make([]float64, pal.Len())
-	diffmat := make([][]float64, pal.Len())
+// sRGB to linear light conversion table
+var linearTable = func() [256]float64 {
+	var result [256]float64
+	for i := range result {
+		c := float64(i) / 255.0
+		if c <= 0.04045 {
+			result[i] = c / 12.92
+		} else {
+			result[i] = math.Pow((c+0.055)/1.055, 2.4)
+		}
+	}
+	return result
+}()
+
+func (color IntColor) ToLinearColor() FloatColor {
+	return FloatColor{linearTable[clipInt(color.R)], linearTable[clipInt(color.G)], linearTable[clipInt(color.B)]}
+}
+
+func newPalComp(pal Palette, linear bool) *PalComp {
+	pc := &PalComp{
+		pal:    pal,
+		linear: linear,
+	}
+	pc.floatpal = make([]FloatColor, pal.Len())
+	pc.lumas = make([]float64, pal.Len())
 	for i, c := range pal {
-		fc := c.ToFloatColor()
-		floatpal[i] = fc
-		lumas[i] = fc.Luma()
-		diffmat[i] = make([]float64, pal.Len())
-		for j, c2 := range pal {
-			diffmat[i][j] = fc.Difference(c2.ToFloatColor())
+		pc.floatpal[i] = pc.SourceColor(c)
+		pc.lumas[i] = pc.floatpal[i].Luma()
+	}
+	pc.diffmatrix = make([][]float64, pal.Len())
+	for i, fc := range pc.floatpal {
+		pc.diffmatrix[i] = make([]float64, pal.Len())
+		for j, fc2 := range pc.floatpal {
+			pc.diffmatrix[i][j] = fc.Difference(fc2)
 		}
 	}
-	return &PalComp{
-		pal:        pal,
-		floatpal:   floatpal,
-		lumas:      lumas,
-		diffmatrix: diffmat,
+	pc.tree = NewKDTree(pc.floatpal)
+	return pc
+}
+
+func NewPalComp(pal Palette) *PalComp {
+	return newPalComp(pal, false)
+}
+
+// All colors (palette and source) are compared and mixed in linear light
+func NewLinearPalComp(pal Palette) *PalComp {
+	return newPalComp(pal, true)
+}
+
+// Converts source pixel to the color space of the palette
+func (pc *PalComp) SourceColor(color IntColor) FloatColor {
+	if pc.linear {
+		return color.ToLinearColor()
 	}
+	return color.ToFloatColor()
 }
 
 func (pc *PalComp) CompareColors(c1 int, c2 int) float64 {
 	return pc.diffmatrix[c1][c2]
 }
 
-func (pc *PalComp) colorDiff(color FloatColor, luma float64, id int) float64 {
-	other := pc.floatpal[id]
+// Same as FloatColor.Difference with precalculated lumas
+func lumaDifference(color FloatColor, luma float64, other FloatColor, otherLuma float64) float64 {
 	diffR := color.R - other.R
 	diffG := color.G - other.G
 	diffB := color.B - other.B
 	diffcolor := diffR*diffR*0.299 + diffG*diffG*0.587 + diffB*diffB*0.114
-	diffluma := luma - pc.lumas[id]
+	diffluma := luma - otherLuma
 	return diffcolor*0.75 + diffluma*diffluma
 }
 
+func (pc *PalComp) colorDiff(color FloatColor, luma float64, id int) float64 {
+	return lumaDifference(color, luma, pc.floatpal[id], pc.lumas[id])
+}
+
 func (pc *PalComp) GetColorIndex(color FloatColor) int {
+	if pc.exhaustive {
+		return pc.GetColorIndexLinear(color)
+	}
+	return pc.tree.Nearest(color)
+}
+
+// Exhaustive search, same result as GetColorIndex
+func (pc *PalComp) GetColorIndexLinear(color FloatColor) int {
 	luma := color.Luma()
 	var minDist float64 = math.MaxFloat64
 	minIndex := 0
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+type PaletteFormat int
+
+const (
+	PalFormatRaw PaletteFormat = iota
+	PalFormatGPL
+	PalFormatJASC
+	PalFormatACT
+	PalFormatACO
+	PalFormatPaintNet
+	PalFormatHex
+	PalFormatPNG
+)
+
+const maxPaletteSize = 256
+
+const swatchCellSize = 8
+const swatchColumns = 16
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func FindPaletteFormat(name string) (PaletteFormat, error) {
+	switch strings.ToLower(name) {
+	case "pal", "raw":
+		return PalFormatRaw, nil
+	case "gpl", "gimp":
+		return PalFormatGPL, nil
+	case "jasc", "jasc-pal", "psp":
+		return PalFormatJASC, nil
+	case "act":
+		return PalFormatACT, nil
+	case "aco":
+		return PalFormatACO, nil
+	case "txt", "paintnet", "paint.net":
+		return PalFormatPaintNet, nil
+	case "hex":
+		return PalFormatHex, nil
+	case "png":
+		return PalFormatPNG, nil
+	default:
+		return PalFormatRaw, fmt.Errorf("unknown palette format \"%s\"", name)
+	}
+}
+
+func (format PaletteFormat) String() string {
+	switch format {
+	case PalFormatRaw:
+		return "raw"
+	case PalFormatGPL:
+		return "gpl"
+	case PalFormatJASC:
+		return "jasc"
+	case PalFormatACT:
+		return "act"
+	case PalFormatACO:
+		return "aco"
+	case PalFormatPaintNet:
+		return "paint.net"
+	case PalFormatHex:
+		return "hex"
+	case PalFormatPNG:
+		return "png"
+	default:
+		return "unknown"
+	}
+}
+
+// Format is guessed from the file contents first, and from the extension if contents are ambiguous
+func DetectPaletteFormat(filename string, data []byte) PaletteFormat {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIMP Palette")):
+		return PalFormatGPL
+	case bytes.HasPrefix(data, []byte("JASC-PAL")):
+		return PalFormatJASC
+	case bytes.HasPrefix(data, pngSignature):
+		return PalFormatPNG
+	}
+	return paletteFormatByExt(filename)
+}
+
+func paletteFormatByExt(filename string) PaletteFormat {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpl":
+		return PalFormatGPL
+	case ".act":
+		return PalFormatACT
+	case ".aco":
+		return PalFormatACO
+	case ".txt":
+		return PalFormatPaintNet
+	case ".hex":
+		return PalFormatHex
+	case ".png":
+		return PalFormatPNG
+	default:
+		return PalFormatRaw
+	}
+}
+
+func checkPaletteSize(pal Palette) error {
+	if pal.Len() == 0 {
+		return errors.New("palette is empty")
+	}
+	if pal.Len() > maxPaletteSize {
+		return fmt.Errorf("palette has %d colors (must be at most %d)", pal.Len(), maxPaletteSize)
+	}
+	return nil
+}
+
+//region LOADING
+
+func DecodePalette(data []byte, format PaletteFormat) (Palette, error) {
+	pal, err := decodePalette(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPaletteSize(pal); err != nil {
+		return nil, err
+	}
+	return pal, nil
+}
+
+// Without the size check
+func decodePalette(data []byte, format PaletteFormat) (Palette, error) {
+	var (
+		pal Palette
+		err error
+	)
+	switch format {
+	case PalFormatRaw:
+		pal, err = decodeRawPalette(data)
+	case PalFormatGPL:
+		pal, err = decodeGPLPalette(data)
+	case PalFormatJASC:
+		pal, err = decodeJASCPalette(data)
+	case PalFormatACT:
+		pal, err = decodeACTPalette(data)
+	case PalFormatACO:
+		pal, err = decodeACOPalette(data)
+	case PalFormatPaintNet, PalFormatHex:
+		pal, err = decodeHexPalette(data)
+	case PalFormatPNG:
+		pal, err = decodePNGPalette(data)
+	default:
+		return nil, fmt.Errorf("unsupported palette format %s", format)
+	}
+	return pal, err
+}
+
+func decodeRawPalette(data []byte) (Palette, error) {
+	if len(data)%3 != 0 {
+		return nil, fmt.Errorf("raw palette size must be a multiple of 3 (got %d bytes)", len(data))
+	}
+	result := make(Palette, len(data)/3)
+	for i := range result {
+		result[i].R = int(data[i*3])
+		result[i].G = int(data[i*3+1])
+		result[i].B = int(data[i*3+2])
+	}
+	return result, nil
+}
+
+func parseColorComponents(fields []string) (IntColor, error) {
+	var components [3]int
+	for i := range components {
+		value, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return IntColor{}, err
+		}
+		if value < 0 || value > 255 {
+			return IntColor{}, fmt.Errorf("color component out of range: %d", value)
+		}
+		components[i] = value
+	}
+	return IntColor{components[0], components[1], components[2]}, nil
+}
+
+func decodeGPLPalette(data []byte) (Palette, error) {
+	result := make(Palette, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if line == 1 {
+			if text != "GIMP Palette" {
+				return nil, errors.New("missing \"GIMP Palette\" header")
+			}
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "Name:") || strings.HasPrefix(text, "Columns:") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected \"R G B [name]\"", line)
+		}
+		color, err := parseColorComponents(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		result = append(result, color)
+	}
+	return result, scanner.Err()
+}
+
+func decodeJASCPalette(data []byte) (Palette, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text != "" {
+			lines = append(lines, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) < 3 || lines[0] != "JASC-PAL" {
+		return nil, errors.New("missing JASC-PAL header")
+	}
+	count, err := strconv.Atoi(lines[2])
+	if err != nil {
+		return nil, fmt.Errorf("wrong color count: %w", err)
+	}
+	if count > len(lines)-3 {
+		return nil, fmt.Errorf("color count is %d, but only %d colors found", count, len(lines)-3)
+	}
+	result := make(Palette, count)
+	for i := range result {
+		fields := strings.Fields(lines[i+3])
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("color %d: expected \"R G B\"", i)
+		}
+		result[i], err = parseColorComponents(fields)
+		if err != nil {
+			return nil, fmt.Errorf("color %d: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
+// Adobe Color Table: 256 RGB triples, optionally followed by u2 color count and u2 transparent index (big-endian)
+func decodeACTPalette(data []byte) (Palette, error) {
+	if len(data) != 768 && len(data) != 772 {
+		return nil, fmt.Errorf("ACT file must be 768 or 772 bytes long (got %d)", len(data))
+	}
+	count := 256
+	if len(data) == 772 {
+		count = int(binary.BigEndian.Uint16(data[768:]))
+		if count == 0 || count > 256 {
+			count = 256
+		}
+	}
+	return decodeRawPalette(data[:count*3])
+}
+
+const (
+	acoSpaceRGB       = 0
+	acoSpaceHSB       = 1
+	acoSpaceGrayscale = 8
+)
+
+func readACOColor(reader *bytes.Reader) (IntColor, error) {
+	var entry struct {
+		Space uint16
+		W     uint16
+		X     uint16
+		Y     uint16
+		Z     uint16
+	}
+	if err := binary.Read(reader, binary.BigEndian, &entry); err != nil {
+		return IntColor{}, err
+	}
+	switch entry.Space {
+	case acoSpaceRGB:
+		return IntColor{int(entry.W >> 8), int(entry.X >> 8), int(entry.Y >> 8)}, nil
+	case acoSpaceHSB:
+		return hsbToIntColor(float64(entry.W)/65536*360, float64(entry.X)/65535, float64(entry.Y)/65535), nil
+	case acoSpaceGrayscale:
+		gray := clipInt(int(float64(entry.W) / 10000 * 255))
+		return IntColor{gray, gray, gray}, nil
+	default:
+		return IntColor{}, fmt.Errorf("unsupported color space %d", entry.Space)
+	}
+}
+
+func hsbToIntColor(hue float64, saturation float64, brightness float64) IntColor {
+	sector := int(hue/60) % 6
+	fraction := hue/60 - float64(int(hue/60))
+	p := brightness * (1 - saturation)
+	q := brightness * (1 - fraction*saturation)
+	t := brightness * (1 - (1-fraction)*saturation)
+	var color FloatColor
+	switch sector {
+	case 0:
+		color = FloatColor{brightness, t, p}
+	case 1:
+		color = FloatColor{q, brightness, p}
+	case 2:
+		color = FloatColor{p, brightness, t}
+	case 3:
+		color = FloatColor{p, q, brightness}
+	case 4:
+		color = FloatColor{t, p, brightness}
+	default:
+		color = FloatColor{brightness, p, q}
+	}
+	return color.ToIntColor()
+}
+
+// Adobe Color Swatch: version 1 section, optionally followed by version 2 section with color names
+func decodeACOPalette(data []byte) (Palette, error) {
+	reader := bytes.NewReader(data)
+	var result Palette
+	for reader.Len() > 0 {
+		var version, count uint16
+		if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		if version != 1 && version != 2 {
+			return nil, fmt.Errorf("wrong ACO version %d", version)
+		}
+		section := make(Palette, count)
+		for i := range section {
+			color, err := readACOColor(reader)
+			if err != nil {
+				return nil, fmt.Errorf("color %d: %w", i, err)
+			}
+			section[i] = color
+			if version == 2 {
+				var nameLength uint32
+				if err := binary.Read(reader, binary.BigEndian, &nameLength); err != nil {
+					return nil, err
+				}
+				if _, err := reader.Seek(int64(nameLength)*2, 1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// Version 2 section contains the same colors, so it replaces version 1
+		result = section
+	}
+	if result == nil {
+		return nil, errors.New("ACO file is empty")
+	}
+	return result, nil
+}
+
+// Both Paint.NET (AARRGGBB) and plain hex lists (RRGGBB), one color per line
+func decodeHexPalette(data []byte) (Palette, error) {
+	result := make(Palette, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		text = strings.TrimPrefix(strings.TrimPrefix(text, "#"), "0x")
+		if len(text) == 8 {
+			text = text[2:]
+		}
+		if len(text) != 6 {
+			return nil, fmt.Errorf("line %d: expected RRGGBB or AARRGGBB", line)
+		}
+		value, err := strconv.ParseUint(text, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		result = append(result, IntColor{int(value>>16) & 0xFF, int(value>>8) & 0xFF, int(value) & 0xFF})
+	}
+	return result, scanner.Err()
+}
+
+// Cell size of a swatch grid, 1 if the image is not made of uniform cells
+func pngSwatchCellSize(img image.Image) int {
+	bounds := img.Bounds()
+	size := swatchCellSize
+	if bounds.Dx()%size != 0 || bounds.Dy()%size != 0 {
+		return 1
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cellX := bounds.Min.X + (x-bounds.Min.X)/size*size
+			cellY := bounds.Min.Y + (y-bounds.Min.Y)/size*size
+			if img.At(x, y) != img.At(cellX, cellY) {
+				return 1
+			}
+		}
+	}
+	return size
+}
+
+// Opaque swatch cells in row-major order, repeated colors are kept.
+// Cells are 8x8 for images written by encodePNGPalette, single pixels otherwise.
+func decodePNGPalette(data []byte) (Palette, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	size := pngSwatchCellSize(img)
+	result := make(Palette, 0)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += size {
+		for x := bounds.Min.X; x < bounds.Max.X; x += size {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			result = append(result, IntColor{int(r / 257), int(g / 257), int(b / 257)})
+		}
+	}
+	return result, nil
+}
+
+//endregion
+
+//region SAVING
+
+func EncodePalette(pal Palette, format PaletteFormat) ([]byte, error) {
+	if err := checkPaletteSize(pal); err != nil {
+		return nil, err
+	}
+	switch format {
+	case PalFormatRaw:
+		return encodeRawPalette(pal), nil
+	case PalFormatGPL:
+		return encodeGPLPalette(pal), nil
+	case PalFormatJASC:
+		return encodeJASCPalette(pal), nil
+	case PalFormatACT:
+		return encodeACTPalette(pal), nil
+	case PalFormatACO:
+		return encodeACOPalette(pal), nil
+	case PalFormatPaintNet:
+		return encodePaintNetPalette(pal), nil
+	case PalFormatHex:
+		return encodeHexPalette(pal), nil
+	case PalFormatPNG:
+		return encodePNGPalette(pal)
+	default:
+		return nil, fmt.Errorf("unsupported palette format %s", format)
+	}
+}
+
+func encodeRawPalette(pal Palette) []byte {
+	data := make([]byte, 0, pal.Len()*3)
+	for _, color := range pal {
+		data = append(data, byte(color.R), byte(color.G), byte(color.B))
+	}
+	return data
+}
+
+func encodeGPLPalette(pal Palette) []byte {
+	var result bytes.Buffer
+	fmt.Fprint(&result, "GIMP Palette\nName: RVC\nColumns: 16\n#\n")
+	for i, color := range pal {
+		fmt.Fprintf(&result, "%3d %3d %3d\tIndex %d\n", color.R, color.G, color.B, i)
+	}
+	return result.Bytes()
+}
+
+func encodeJASCPalette(pal Palette) []byte {
+	var result bytes.Buffer
+	fmt.Fprintf(&result, "JASC-PAL\r\n0100\r\n%d\r\n", pal.Len())
+	for _, color := range pal {
+		fmt.Fprintf(&result, "%d %d %d\r\n", color.R, color.G, color.B)
+	}
+	return result.Bytes()
+}
+
+func encodeACTPalette(pal Palette) []byte {
+	result := make([]byte, 772)
+	copy(result, encodeRawPalette(pal))
+	binary.BigEndian.PutUint16(result[768:], uint16(pal.Len()))
+	binary.BigEndian.PutUint16(result[770:], 0xFFFF)
+	return result
+}
+
+func encodeACOPalette(pal Palette) []byte {
+	var result bytes.Buffer
+	for version := uint16(1); version <= 2; version++ {
+		binary.Write(&result, binary.BigEndian, version)
+		binary.Write(&result, binary.BigEndian, uint16(pal.Len()))
+		for i, color := range pal {
+			binary.Write(&result, binary.BigEndian, []uint16{
+				acoSpaceRGB,
+				uint16(color.R) * 257,
+				uint16(color.G) * 257,
+				uint16(color.B) * 257,
+				0})
+			if version == 2 {
+				name := utf16.Encode([]rune(fmt.Sprintf("Index %d", i)))
+				binary.Write(&result, binary.BigEndian, uint32(len(name)+1))
+				binary.Write(&result, binary.BigEndian, name)
+				binary.Write(&result, binary.BigEndian, uint16(0))
+			}
+		}
+	}
+	return result.Bytes()
+}
+
+func encodePaintNetPalette(pal Palette) []byte {
+	var result bytes.Buffer
+	fmt.Fprint(&result, "; paint.net Palette File\r\n")
+	fmt.Fprintf(&result, "; Colors: %d\r\n", pal.Len())
+	for _, color := range pal {
+		fmt.Fprintf(&result, "FF%02X%02X%02X\r\n", color.R, color.G, color.B)
+	}
+	return result.Bytes()
+}
+
+func encodeHexPalette(pal Palette) []byte {
+	var result bytes.Buffer
+	for _, color := range pal {
+		fmt.Fprintf(&result, "%02x%02x%02x\n", color.R, color.G, color.B)
+	}
+	return result.Bytes()
+}
+
+func encodePNGPalette(pal Palette) ([]byte, error) {
+	rows := (pal.Len() + swatchColumns - 1) / swatchColumns
+	columns := swatchColumns
+	if pal.Len() < columns {
+		columns = pal.Len()
+	}
+	img := image.NewRGBA(image.Rect(0, 0, columns*swatchCellSize, rows*swatchCellSize))
+	for i, color := range pal {
+		cellX := (i % swatchColumns) * swatchCellSize
+		cellY := (i / swatchColumns) * swatchCellSize
+		for y := cellY; y < cellY+swatchCellSize; y++ {
+			for x := cellX; x < cellX+swatchCellSize; x++ {
+				offset := img.PixOffset(x, y)
+				img.Pix[offset] = uint8(color.R)
+				img.Pix[offset+1] = uint8(color.G)
+				img.Pix[offset+2] = uint8(color.B)
+				img.Pix[offset+3] = 255
+			}
+		}
+	}
+	var result bytes.Buffer
+	if err := png.Encode(&result, img); err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+//endregion
+
+func (pal Palette) SaveAs(filename string, format PaletteFormat) error {
+	data, err := EncodePalette(pal, format)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// Repeated colors are kept unless dedupe is set
+func ConvertPalette(input string, output string, format string, dedupe bool) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	pal, err := decodePalette(data, DetectPaletteFormat(input, data))
+	if err == nil && dedupe {
+		pal = pal.Unique()
+	}
+	if err == nil {
+		err = checkPaletteSize(pal)
+		if err != nil && !dedupe {
+			err = fmt.Errorf("%w, use --dedupe to drop repeated colors", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't load palette \"%s\": %w", input, err)
+	}
+	outFormat := paletteFormatByExt(output)
+	if format != "" {
+		outFormat, err = FindPaletteFormat(format)
+		if err != nil {
+			return err
+		}
+	}
+	if err = pal.SaveAs(output, outFormat); err != nil {
+		return err
+	}
+	fmt.Printf("Converted %d colors to %s\n", pal.Len(), outFormat)
+	return nil
+}
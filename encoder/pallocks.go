@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type LockedColor struct {
+	Index int
+	Color IntColor
+}
+
+type LockedColors []LockedColor
+
+// Format: "index=RRGGBB,index=RRGGBB", e.g. "0=000000,255=#ff8000"
+func ParseLockedColors(input string) (LockedColors, error) {
+	result := make(LockedColors, 0)
+	if strings.TrimSpace(input) == "" {
+		return result, nil
+	}
+	used := make(map[int]bool)
+	for _, entry := range strings.Split(input, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("wrong locked color \"%s\" (must be index=RRGGBB)", entry)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || index < 0 || index >= maxPaletteSize {
+			return nil, fmt.Errorf("wrong locked color index \"%s\"", parts[0])
+		}
+		if used[index] {
+			return nil, fmt.Errorf("palette index %d is locked twice", index)
+		}
+		used[index] = true
+		colors, err := decodeHexPalette([]byte(strings.TrimSpace(parts[1])))
+		if err != nil || len(colors) != 1 {
+			return nil, fmt.Errorf("wrong locked color value \"%s\"", parts[1])
+		}
+		result = append(result, LockedColor{Index: index, Color: colors[0]})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result, nil
+}
+
+func (locked LockedColors) MaxIndex() int {
+	if len(locked) == 0 {
+		return -1
+	}
+	return locked[len(locked)-1].Index
+}
+
+// Places locked colors at their indices and fills the rest of the palette with free colors in order
+func (locked LockedColors) Apply(free Palette) Palette {
+	result := make(Palette, len(free)+len(locked))
+	next := 0
+	for i := range result {
+		if color, ok := locked.find(i); ok {
+			result[i] = color
+		} else {
+			result[i] = free[next]
+			next++
+		}
+	}
+	return result
+}
+
+func (locked LockedColors) find(index int) (IntColor, bool) {
+	for _, lock := range locked {
+		if lock.Index == index {
+			return lock.Color, true
+		}
+	}
+	return IntColor{}, false
+}
+
+// Sorts free entries of the palette by luma, locked entries stay at their indices
+func (locked LockedColors) Sort(pal Palette) {
+	free := make(Palette, 0, len(pal))
+	for i, color := range pal {
+		if _, ok := locked.find(i); !ok {
+			free = append(free, color)
+		}
+	}
+	free.Sort()
+	copy(pal, locked.Apply(free))
+}
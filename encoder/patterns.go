@@ -1,10 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/gob"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// Pattern dithering finds order candidate colors for every pixel, PNG patterns can't have more levels either
+const maxPatternOrder = 256
+
 type Pattern struct {
 	Width  int
 	Height int
@@ -49,32 +61,206 @@ func NewPattern(width int, height int, order int) *Pattern {
 		Data:   make([]int, width*height)}
 }
 
-func LoadPattern(filename string) *Pattern {
-	var result *Pattern
+// Format is chosen by extension:
+// - *.png  grayscale threshold map, distinct gray values become levels in ascending order
+// - *.txt  rows of levels separated by spaces, optional "order N" line, "#" comments
+// - other  gob encoded Pattern
+func LoadPattern(filename string) (*Pattern, error) {
+	var (
+		result *Pattern
+		err    error
+	)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png":
+		result, err = loadPatternPNG(filename)
+	case ".txt":
+		result, err = loadPatternText(filename)
+	default:
+		result, err = loadPatternGob(filename)
+	}
+	if err == nil {
+		err = result.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't load pattern \"%s\": %w", filename, err)
+	}
+	return result, nil
+}
+
+func loadPatternGob(filename string) (*Pattern, error) {
+	result := &Pattern{}
 	file, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer file.Close()
 	dec := gob.NewDecoder(file)
 	err = dec.Decode(result)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return result
+	return result, nil
+}
+
+func loadPatternText(filename string) (*Pattern, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	result := &Pattern{Order: -1, Data: make([]int, 0)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if fields[0] == "order" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected \"order N\"", line)
+			}
+			if result.Order, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		if result.Width == 0 {
+			result.Width = len(fields)
+		} else if len(fields) != result.Width {
+			return nil, fmt.Errorf("line %d: row has %d values (must be %d)", line, len(fields), result.Width)
+		}
+		for _, field := range fields {
+			value, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			result.Data = append(result.Data, value)
+		}
+		result.Height++
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if result.Order < 0 {
+		for _, value := range result.Data {
+			if value+1 > result.Order {
+				result.Order = value + 1
+			}
+		}
+	}
+	return result, nil
+}
+
+func loadPatternPNG(filename string) (*Pattern, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	grays := make([]int, 0, bounds.Dx()*bounds.Dy())
+	var used [256]bool
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			grays = append(grays, gray)
+			used[gray] = true
+		}
+	}
+	var levels [256]int
+	order := 0
+	for gray, isUsed := range used {
+		if isUsed {
+			levels[gray] = order
+			order++
+		}
+	}
+	result := NewPattern(bounds.Dx(), bounds.Dy(), order)
+	for i, gray := range grays {
+		result.Data[i] = levels[gray]
+	}
+	return result, nil
+}
+
+func (pattern *Pattern) Validate() error {
+	if pattern.Width <= 0 || pattern.Height <= 0 {
+		return fmt.Errorf("wrong pattern size %dx%d", pattern.Width, pattern.Height)
+	}
+	if len(pattern.Data) != pattern.Width*pattern.Height {
+		return fmt.Errorf("pattern has %d values (must be %d for %dx%d)", len(pattern.Data), pattern.Width*pattern.Height, pattern.Width, pattern.Height)
+	}
+	if pattern.Order < 1 || pattern.Order > maxPatternOrder {
+		return fmt.Errorf("wrong pattern order %d (must be from 1 to %d)", pattern.Order, maxPatternOrder)
+	}
+	for i, value := range pattern.Data {
+		if value < 0 || value >= pattern.Order {
+			return fmt.Errorf("pattern value %d at (%d, %d) is out of range 0..%d", value, i%pattern.Width, i/pattern.Width, pattern.Order-1)
+		}
+	}
+	return nil
 }
 
-func (pattern *Pattern) Save(filename string) {
+// Format is chosen by extension, same as in LoadPattern
+func (pattern *Pattern) Save(filename string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png":
+		return pattern.savePNG(filename)
+	case ".txt":
+		return pattern.saveText(filename)
+	default:
+		return pattern.saveGob(filename)
+	}
+}
+
+func (pattern *Pattern) saveGob(filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 	enc := gob.NewEncoder(file)
-	err = enc.Encode(pattern)
+	return enc.Encode(pattern)
+}
+
+func (pattern *Pattern) saveText(filename string) error {
+	var result bytes.Buffer
+	digits := len(strconv.Itoa(pattern.Order - 1))
+	fmt.Fprintf(&result, "order %d\n", pattern.Order)
+	for y := 0; y < pattern.Height; y++ {
+		for x := 0; x < pattern.Width; x++ {
+			if x > 0 {
+				result.WriteByte(' ')
+			}
+			fmt.Fprintf(&result, "%*d", digits, pattern.Data[x+y*pattern.Width])
+		}
+		result.WriteByte('\n')
+	}
+	return os.WriteFile(filename, result.Bytes(), 0644)
+}
+
+// Levels are spread over the whole gray range
+func (pattern *Pattern) savePNG(filename string) error {
+	if pattern.Order > 256 {
+		return fmt.Errorf("pattern order %d is too big for PNG (must be at most 256)", pattern.Order)
+	}
+	img := image.NewGray(image.Rect(0, 0, pattern.Width, pattern.Height))
+	for i, value := range pattern.Data {
+		if pattern.Order > 1 {
+			img.Pix[i] = uint8(value * 255 / (pattern.Order - 1))
+		}
+	}
+	file, err := os.Create(filename)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer file.Close()
+	return png.Encode(file, img)
 }
 
 func (pattern *Pattern) Reshape(width int, height int) *Pattern {
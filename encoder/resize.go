@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type FitMode int
+
+const (
+	FitLetterbox FitMode = iota // whole frame is visible, free space is black
+	FitCrop                     // whole output is covered, frame edges are cut
+	FitStretch                  // frame is scaled to output size ignoring aspect ratio
+)
+
+type ResizeFilter int
+
+const (
+	FilterNearest ResizeFilter = iota
+	FilterBilinear
+	FilterLanczos
+)
+
+func FindFitMode(name string) (FitMode, error) {
+	switch strings.ToLower(name) {
+	case "letterbox", "":
+		return FitLetterbox, nil
+	case "crop":
+		return FitCrop, nil
+	case "stretch":
+		return FitStretch, nil
+	default:
+		return FitLetterbox, fmt.Errorf("unknown fit mode \"%s\" (must be letterbox, crop or stretch)", name)
+	}
+}
+
+func FindResizeFilter(name string) (ResizeFilter, error) {
+	switch strings.ToLower(name) {
+	case "nearest":
+		return FilterNearest, nil
+	case "bilinear", "":
+		return FilterBilinear, nil
+	case "lanczos":
+		return FilterLanczos, nil
+	default:
+		return FilterBilinear, fmt.Errorf("unknown resize filter \"%s\" (must be nearest, bilinear or lanczos)", name)
+	}
+}
+
+// Pixel aspect is width/height of one output pixel, as "N:M" or a number
+func ParsePixelAspect(value string) (float64, error) {
+	if value == "" {
+		return 1.0, nil
+	}
+	var num, den float64
+	if _, err := fmt.Sscanf(value, "%g:%g", &num, &den); err == nil && num > 0 && den > 0 {
+		return num / den, nil
+	}
+	if _, err := fmt.Sscanf(value, "%g", &num); err == nil && num > 0 {
+		return num, nil
+	}
+	return 0, fmt.Errorf("wrong pixel aspect \"%s\" (must be N:M or a number)", value)
+}
+
+func (filter ResizeFilter) support() float64 {
+	switch filter {
+	case FilterBilinear:
+		return 1
+	case FilterLanczos:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func (filter ResizeFilter) weight(x float64) float64 {
+	x = math.Abs(x)
+	switch filter {
+	case FilterBilinear:
+		return math.Max(0, 1-x)
+	case FilterLanczos:
+		if x >= 3 {
+			return 0
+		}
+		return sinc(x) * sinc(x/3)
+	default:
+		return 1
+	}
+}
+
+//region RESIZER
+
+type resizeContrib struct {
+	first   int
+	weights []float64
+}
+
+// Scales and places frames of any size into output frame
+type FrameResizer struct {
+	width       int
+	height      int
+	fit         FitMode
+	filter      ResizeFilter
+	pixelAspect float64
+}
+
+func NewFrameResizer(width int, height int, fit FitMode, filter ResizeFilter, pixelAspect float64) *FrameResizer {
+	return &FrameResizer{
+		width:       width,
+		height:      height,
+		fit:         fit,
+		filter:      filter,
+		pixelAspect: pixelAspect,
+	}
+}
+
+func (resizer *FrameResizer) Size() (int, int) {
+	return resizer.width, resizer.height
+}
+
+// Weights of source pixels for every output pixel.
+// Output pixels [0, dstSize) cover source range [srcStart, srcStart+srcLength).
+func (resizer *FrameResizer) contributions(srcSize int, srcStart float64, srcLength float64, dstSize int) []resizeContrib {
+	result := make([]resizeContrib, dstSize)
+	step := srcLength / float64(dstSize)
+	// Filter is widened when downscaling, so it averages all covered pixels
+	scale := math.Max(step, 1)
+	radius := resizer.filter.support() * scale
+	for i := range result {
+		center := srcStart + (float64(i)+0.5)*step
+		if resizer.filter == FilterNearest {
+			index := clampIndex(int(math.Floor(center)), srcSize)
+			result[i] = resizeContrib{index, []float64{1}}
+			continue
+		}
+		first := int(math.Floor(center - radius))
+		last := int(math.Ceil(center + radius))
+		weights := make([]float64, last-first+1)
+		total := 0.0
+		for j := range weights {
+			weights[j] = resizer.filter.weight((float64(first+j) + 0.5 - center) / scale)
+			total += weights[j]
+		}
+		if total != 0 {
+			for j := range weights {
+				weights[j] /= total
+			}
+		}
+		result[i] = resizeContrib{first, weights}
+	}
+	return result
+}
+
+func clampIndex(index int, size int) int {
+	if index < 0 {
+		return 0
+	}
+	if index >= size {
+		return size - 1
+	}
+	return index
+}
+
+// Source area (in source pixels) and output area (in output pixels) for the fit mode
+func (resizer *FrameResizer) placement(srcWidth int, srcHeight int) (srcX, srcY, srcW, srcH float64, dstX, dstY, dstW, dstH int) {
+	srcW, srcH = float64(srcWidth), float64(srcHeight)
+	dstW, dstH = resizer.width, resizer.height
+	// Output size in square pixels
+	outW := float64(resizer.width) * resizer.pixelAspect
+	outH := float64(resizer.height)
+	switch resizer.fit {
+	case FitLetterbox:
+		scale := math.Min(outW/srcW, outH/srcH)
+		dstW = clampIndex(int(math.Round(srcW*scale/resizer.pixelAspect)), resizer.width+1)
+		dstH = clampIndex(int(math.Round(srcH*scale)), resizer.height+1)
+		if dstW < 1 {
+			dstW = 1
+		}
+		if dstH < 1 {
+			dstH = 1
+		}
+		dstX = (resizer.width - dstW) / 2
+		dstY = (resizer.height - dstH) / 2
+	case FitCrop:
+		scale := math.Max(outW/srcW, outH/srcH)
+		w := outW / scale
+		h := outH / scale
+		srcX = (srcW - w) / 2
+		srcY = (srcH - h) / 2
+		srcW, srcH = w, h
+	}
+	return
+}
+
+func (resizer *FrameResizer) Resize(frame Frame) Frame {
+	if frame.Width == resizer.width && frame.Height == resizer.height && resizer.pixelAspect == 1 {
+		return frame
+	}
+	srcX, srcY, srcW, srcH, dstX, dstY, dstW, dstH := resizer.placement(frame.Width, frame.Height)
+	columns := resizer.contributions(frame.Width, srcX, srcW, dstW)
+	rows := resizer.contributions(frame.Height, srcY, srcH, dstH)
+
+	// Horizontal pass for all source rows, then vertical pass
+	temp := make([]FloatColor, dstW*frame.Height)
+	for y := 0; y < frame.Height; y++ {
+		line := frame.Data[y*frame.Width : (y+1)*frame.Width]
+		for x, contrib := range columns {
+			var acc FloatColor
+			for j, weight := range contrib.weights {
+				color := line[clampIndex(contrib.first+j, frame.Width)]
+				acc.R += float64(color.R) * weight
+				acc.G += float64(color.G) * weight
+				acc.B += float64(color.B) * weight
+			}
+			temp[y*dstW+x] = acc
+		}
+	}
+
+	result := make([]IntColor, resizer.width*resizer.height)
+	for y, contrib := range rows {
+		for x := 0; x < dstW; x++ {
+			var acc FloatColor
+			for j, weight := range contrib.weights {
+				color := temp[clampIndex(contrib.first+j, frame.Height)*dstW+x]
+				acc.R += color.R * weight
+				acc.G += color.G * weight
+				acc.B += color.B * weight
+			}
+			result[(dstY+y)*resizer.width+dstX+x] = IntColor{
+				clipInt(int(math.Round(acc.R))),
+				clipInt(int(math.Round(acc.G))),
+				clipInt(int(math.Round(acc.B))),
+			}
+		}
+	}
+	return Frame{result, resizer.width, resizer.height}
+}
+
+//endregion
@@ -1,13 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 )
 
+type RVFIndexEntry struct {
+	Offset int64 // of the frame in file
+	Flags  uint8
+}
+
+// Writes RVF file. Frame count and index are written on Close if output is seekable,
+// otherwise frame count is unknown and the stream ends with FrameIsLast flag.
 type RVFfile struct {
-	file *os.File
+	output io.Writer
+	file   io.WriteSeeker // nil if output is not seekable
+	start  int64          // position of the file where writing started
+	writer *bufio.Writer
+	flags  uint8
+	header []byte // header and palette, kept for checksum
+	offset int64  // of the next write
+	frames int
+	index  []RVFIndexEntry
 }
 
 const (
@@ -15,78 +35,223 @@ const (
 	CompressionFull uint8 = 0b00000001
 	AudioBlock      uint8 = 0b00000010
 	AudioStream     uint8 = 0b00000100
+	Checksums       uint8 = 0b00001000
 	FrameRegular    uint8 = 0b00000000
 	FrameIsKeyframe uint8 = 0b00000001
 	FrameIsFirst    uint8 = 0b00000010
 	FrameIsLast     uint8 = 0b00000100
+	Index           uint8 = 0b00010000
+	Metadata        uint8 = 0b00100000
 )
 
-var magic = [4]byte{'R', 'V', 'F', 3}
+// Frame count of streams written without seeking, frames are read until FrameIsLast
+const UnknownFrameCount = 0xFFFFFFFF
+
+// Version 4 added ADPCM audio, checksums, unknown frame count, index and metadata, version 3 files are still read
+var magic = [4]byte{'R', 'V', 'F', 4}
+var indexMagic = [4]byte{'R', 'V', 'F', 'X'}
+
+const oldestRVFVersion = 3
+
+// Standard output at start, stays valid if os.Stdout is redirected for messages
+var stdout = os.Stdout
+
+type RVFMetadata struct {
+	Title string // up to 255 bytes
+}
 
 func write(file io.Writer, data interface{}) {
 	binary.Write(file, binary.LittleEndian, data)
 }
 
-func NewRVFfile(filename string, palette Palette, width int, height int, frames int, frameRate float32, flags uint8, audio *WAVfile) *RVFfile {
-	result := &RVFfile{}
-	var err error
-	result.file, err = os.Create(filename)
+// Filename "-" is for standard output
+func NewRVFfile(filename string, palette Palette, width int, height int, frameRate float32, flags uint8, audio *WAVfile, metadata *RVFMetadata) (*RVFfile, error) {
+	if filename == "-" {
+		return NewRVFWriter(stdout, palette, width, height, frameRate, flags, audio, metadata)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	result, err := NewRVFWriter(file, palette, width, height, frameRate, flags, audio, metadata)
 	if err != nil {
-		panic(err)
+		file.Close()
 	}
+	return result, err
+}
+
+// Output is closed by Close if it is io.Closer.
+// Not seekable output needs compression, only compressed frames can mark the last one.
+func NewRVFWriter(output io.Writer, palette Palette, width int, height int, frameRate float32, flags uint8, audio *WAVfile, metadata *RVFMetadata) (*RVFfile, error) {
+	result := &RVFfile{output: output, writer: bufio.NewWriter(output)}
+	// Pipes are files too, but can't seek
+	if file, ok := output.(io.WriteSeeker); ok {
+		if start, err := file.Seek(0, io.SeekCurrent); err == nil {
+			result.file = file
+			result.start = start
+		}
+	}
+	if result.file == nil && flags&CompressionFull == 0 {
+		return nil, errors.New("uncompressed rvf can't be written to not seekable output, use compression (-c)")
+	}
+	if audio != nil {
+		flags |= AudioBlock
+	}
+	if metadata != nil {
+		if len(metadata.Title) > 255 {
+			return nil, errors.New("title is longer than 255 bytes")
+		}
+		flags |= Metadata
+	}
+	if result.file != nil && flags&CompressionFull != 0 {
+		flags |= Index
+	}
+	result.flags = flags
+	frames := uint32(UnknownFrameCount)
+	if result.file != nil {
+		// Placeholder, patched on Close
+		frames = 0
+	}
+
+	var header bytes.Buffer
 
 	// Magic
-	result.file.Write(magic[:])
+	header.Write(magic[:])
 
 	// Header
-	write(result.file, uint32(width))
-	write(result.file, uint32(height))
-	write(result.file, uint32(frames))
-	write(result.file, float32(1/frameRate))
-	if audio == nil {
-		write(result.file, flags)
-	} else {
-		write(result.file, flags|AudioBlock)
-		write(result.file, uint8(audio.Cannels))
-		write(result.file, uint32(audio.SampleRate))
-		if audio.IsHiQuality {
-			write(result.file, uint8(1))
-		} else {
-			write(result.file, uint8(0))
+	write(&header, uint32(width))
+	write(&header, uint32(height))
+	write(&header, frames)
+	write(&header, float32(1/frameRate))
+	write(&header, flags)
+	if audio != nil {
+		write(&header, uint8(audio.Cannels))
+		write(&header, uint32(audio.SampleRate))
+		write(&header, audio.Codec)
+		if audio.Codec == AudioCodecADPCM {
+			write(&header, uint16(audio.BlockAlign))
 		}
 	}
 
+	//Metadata
+	if metadata != nil {
+		write(&header, uint32(1+len(metadata.Title)))
+		write(&header, uint8(len(metadata.Title)))
+		header.WriteString(metadata.Title)
+	}
+
 	//Palette
-	write(result.file, uint8(palette.Len()-1))
+	write(&header, uint8(palette.Len()-1))
 	for _, color := range palette {
-		write(result.file, uint8(color.R))
-		write(result.file, uint8(color.G))
-		write(result.file, uint8(color.B))
+		write(&header, uint8(color.R))
+		write(&header, uint8(color.G))
+		write(&header, uint8(color.B))
+	}
+
+	result.header = header.Bytes()
+	result.Write(result.header)
+	if flags&Checksums != 0 {
+		write(result, crc32.ChecksumIEEE(result.header))
 	}
 
 	//Audio block
 	if audio != nil {
-		write(result.file, uint32(len(audio.Data)))
-		result.file.Write(audio.Data)
+		write(result, uint32(len(audio.Data)))
+		result.Write(audio.Data)
 	}
 
-	return result
+	return result, nil
+}
+
+// Writes to output keeping track of the offset
+func (rvf *RVFfile) Write(data []byte) (int, error) {
+	n, err := rvf.writer.Write(data)
+	rvf.offset += int64(n)
+	return n, err
 }
 
 func (rvf *RVFfile) WriteRaw(data []int) {
-	for _, item := range data {
-		write(rvf.file, byte(item))
+	frame := make([]byte, len(data))
+	for i, item := range data {
+		frame[i] = byte(item)
 	}
+	rvf.Write(frame)
+	rvf.frames++
 }
 
 func (rvf *RVFfile) WriteCompressed(data []byte, flags uint8) {
+	rvf.index = append(rvf.index, RVFIndexEntry{Offset: rvf.offset, Flags: flags})
 	frameSize := len(data) + 1 + 4
-	write(rvf.file, uint32(frameSize))
-	write(rvf.file, flags)
-	rvf.file.Write(data)
-	write(rvf.file, uint32(frameSize))
+	if rvf.flags&Checksums != 0 {
+		frameSize += 4
+	}
+	write(rvf, uint32(frameSize))
+	write(rvf, flags)
+	rvf.Write(data)
+	if rvf.flags&Checksums != 0 {
+		write(rvf, frameChecksum(flags, data))
+	}
+	write(rvf, uint32(frameSize))
+	rvf.frames++
 }
 
-func (rvf *RVFfile) Close() {
-	rvf.file.Close()
+// CRC32 of frame flags and data
+func frameChecksum(flags uint8, data []byte) uint32 {
+	checksum := crc32.Update(0, crc32.IEEETable, []byte{flags})
+	return crc32.Update(checksum, crc32.IEEETable, data)
+}
+
+func (rvf *RVFfile) writeIndex() {
+	var index bytes.Buffer
+	index.Write(indexMagic[:])
+	write(&index, uint32(len(rvf.index)))
+	for _, entry := range rvf.index {
+		write(&index, uint64(entry.Offset))
+		write(&index, entry.Flags)
+	}
+	write(&index, uint32(index.Len()+4))
+	rvf.Write(index.Bytes())
+}
+
+// Writes to file at offset from the start of rvf
+func (rvf *RVFfile) writeAt(offset int64, data interface{}) error {
+	if _, err := rvf.file.Seek(rvf.start+offset, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(rvf.file, binary.LittleEndian, data)
+}
+
+// Patches frame count in the header, file position is restored after it
+func (rvf *RVFfile) writeFrameCount() error {
+	binary.LittleEndian.PutUint32(rvf.header[len(magic)+8:], uint32(rvf.frames))
+	if err := rvf.writeAt(int64(len(magic)+8), uint32(rvf.frames)); err != nil {
+		return err
+	}
+	if rvf.flags&Checksums != 0 {
+		if err := rvf.writeAt(int64(len(rvf.header)), crc32.ChecksumIEEE(rvf.header)); err != nil {
+			return err
+		}
+	}
+	_, err := rvf.file.Seek(rvf.start+rvf.offset, io.SeekStart)
+	return err
+}
+
+// Returns the first write error, output is closed anyway
+func (rvf *RVFfile) Close() error {
+	if rvf.flags&Index != 0 {
+		rvf.writeIndex()
+	}
+	err := rvf.writer.Flush()
+	if err == nil && rvf.file != nil {
+		err = rvf.writeFrameCount()
+	}
+	if closer, ok := rvf.output.(io.Closer); ok && rvf.output != stdout {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't write rvf: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+type RVFAudioFormat struct {
+	Channels   int
+	SampleRate uint
+	Codec      uint8
+	BlockAlign int // ADPCM only
+}
+
+type RVFHeader struct {
+	Version   int
+	Width     int
+	Height    int
+	Frames    int // -1 if unknown, frames are read until FrameIsLast
+	FrameTime float32
+	Flags     uint8
+	Audio     *RVFAudioFormat
+	Metadata  *RVFMetadata
+}
+
+type RVFFrame struct {
+	Offset    int64 // in file
+	Flags     uint8 // compressed files only
+	Data      []byte
+	Corrupted bool // checksum doesn't match
+}
+
+type RVFReader struct {
+	file      *os.File
+	reader    *countingReader
+	size      int64
+	framesEnd int64 // index starts here
+	last      bool  // frame with FrameIsLast was read
+	Header    RVFHeader
+	Palette   Palette
+	AudioData []byte
+	Index     []RVFIndexEntry // nil if file has no index or it is broken
+
+	HeaderCorrupted bool // checksum of header and palette doesn't match
+}
+
+// Keeps track of the position in file, optionally calculates checksum of read data
+type countingReader struct {
+	reader   *bufio.Reader
+	pos      int64
+	checksum hash.Hash32
+}
+
+func (reader *countingReader) Read(data []byte) (int, error) {
+	n, err := reader.reader.Read(data)
+	reader.pos += int64(n)
+	if reader.checksum != nil {
+		reader.checksum.Write(data[:n])
+	}
+	return n, err
+}
+
+var ErrNotRVF = errors.New("not a RVF file")
+
+// Converts io.ErrUnexpectedEOF and io.EOF inside of a structure to ErrTruncated
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+func OpenRVF(filename string) (*RVFReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	result := &RVFReader{file: file, reader: &countingReader{reader: bufio.NewReader(file)}}
+	if stat, err := file.Stat(); err == nil {
+		result.size = stat.Size()
+	}
+	result.framesEnd = result.size
+	if err := result.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can't read rvf \"%s\": %w", filename, err)
+	}
+	if result.Header.Flags&Index != 0 {
+		result.readIndex()
+	}
+	return result, nil
+}
+
+func (rvf *RVFReader) read(data interface{}) error {
+	return truncated(binary.Read(rvf.reader, binary.LittleEndian, data))
+}
+
+func (rvf *RVFReader) readHeader() error {
+	rvf.reader.checksum = crc32.NewIEEE()
+	var fileMagic [4]byte
+	if _, err := io.ReadFull(rvf.reader, fileMagic[:]); err != nil || string(fileMagic[:3]) != string(magic[:3]) {
+		return ErrNotRVF
+	}
+	version := fileMagic[3]
+	if version < oldestRVFVersion || version > magic[3] {
+		return fmt.Errorf("unsupported RVF version %d", version)
+	}
+	var header struct {
+		Width     uint32
+		Height    uint32
+		Frames    uint32
+		FrameTime float32
+		Flags     uint8
+	}
+	if err := rvf.read(&header); err != nil {
+		return err
+	}
+	rvf.Header = RVFHeader{
+		Version:   int(version),
+		Width:     int(header.Width),
+		Height:    int(header.Height),
+		Frames:    int(header.Frames),
+		FrameTime: header.FrameTime,
+		Flags:     header.Flags,
+	}
+	if version < 4 && header.Flags&(Checksums|Index|Metadata) != 0 {
+		return fmt.Errorf("flags 0x%02X are not supported in RVF version %d", header.Flags, version)
+	}
+	if header.Frames == UnknownFrameCount {
+		rvf.Header.Frames = -1
+	}
+	if header.Flags&(AudioBlock|AudioStream) != 0 {
+		var format struct {
+			Channels   uint8
+			SampleRate uint32
+			Codec      uint8
+		}
+		if err := rvf.read(&format); err != nil {
+			return err
+		}
+		audio := &RVFAudioFormat{
+			Channels:   int(format.Channels),
+			SampleRate: uint(format.SampleRate),
+			Codec:      format.Codec,
+		}
+		if audio.Codec == AudioCodecADPCM && version < 4 {
+			return fmt.Errorf("ADPCM audio is not supported in RVF version %d", version)
+		}
+		if audio.Codec == AudioCodecADPCM {
+			var blockAlign uint16
+			if err := rvf.read(&blockAlign); err != nil {
+				return err
+			}
+			audio.BlockAlign = int(blockAlign)
+		}
+		rvf.Header.Audio = audio
+	}
+
+	if header.Flags&Metadata != 0 {
+		metadata, err := rvf.readMetadata()
+		if err != nil {
+			return err
+		}
+		rvf.Header.Metadata = metadata
+	}
+
+	var paletteSize uint8
+	if err := rvf.read(&paletteSize); err != nil {
+		return err
+	}
+	colors := make([]byte, (int(paletteSize)+1)*3)
+	if _, err := io.ReadFull(rvf.reader, colors); err != nil {
+		return truncated(err)
+	}
+	rvf.Palette = make(Palette, int(paletteSize)+1)
+	for i := range rvf.Palette {
+		rvf.Palette[i] = IntColor{int(colors[i*3]), int(colors[i*3+1]), int(colors[i*3+2])}
+	}
+
+	checksum := rvf.reader.checksum.Sum32()
+	rvf.reader.checksum = nil
+	if header.Flags&Checksums != 0 {
+		var stored uint32
+		if err := rvf.read(&stored); err != nil {
+			return err
+		}
+		rvf.HeaderCorrupted = stored != checksum
+	}
+
+	if header.Flags&AudioBlock != 0 {
+		var size uint32
+		if err := rvf.read(&size); err != nil {
+			return err
+		}
+		rvf.AudioData = make([]byte, size)
+		if _, err := io.ReadFull(rvf.reader, rvf.AudioData); err != nil {
+			return truncated(err)
+		}
+	}
+	return nil
+}
+
+// Fields after the title are skipped, they may be added in later versions
+func (rvf *RVFReader) readMetadata() (*RVFMetadata, error) {
+	var size uint32
+	if err := rvf.read(&size); err != nil {
+		return nil, err
+	}
+	if int64(size) > rvf.size {
+		return nil, fmt.Errorf("metadata size %d is larger than the file", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rvf.reader, data); err != nil {
+		return nil, truncated(err)
+	}
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, errors.New("metadata title doesn't fit into metadata")
+	}
+	return &RVFMetadata{Title: string(data[1 : 1+int(data[0])])}, nil
+}
+
+// Index is found by its size at the end of file
+func (rvf *RVFReader) readIndex() {
+	size, ok := rvf.readUint32At(rvf.size - 4)
+	if !ok || int64(size) < 4+4+4 || int64(size) > rvf.size {
+		return
+	}
+	data := make([]byte, size)
+	if _, err := rvf.file.ReadAt(data, rvf.size-int64(size)); err != nil || string(data[:4]) != string(indexMagic[:]) {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if 4+4+count*9+4 != len(data) {
+		return
+	}
+	index := make([]RVFIndexEntry, count)
+	for i := range index {
+		entry := data[8+i*9:]
+		index[i] = RVFIndexEntry{Offset: int64(binary.LittleEndian.Uint64(entry)), Flags: entry[8]}
+	}
+	rvf.Index = index
+	rvf.framesEnd = rvf.size - int64(size)
+}
+
+// Decodes audio block to samples
+func (rvf *RVFReader) Audio() (*AudioBuffer, error) {
+	format := rvf.Header.Audio
+	if format == nil {
+		return nil, nil
+	}
+	data := rvf.AudioData
+	sampleSize := 2
+	switch format.Codec {
+	case AudioCodecPCM8:
+		sampleSize = 1
+	case AudioCodecPCM16:
+	case AudioCodecADPCM:
+		samples, err := DecodeADPCM(data, format.Channels, format.BlockAlign)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, len(samples)*2)
+		for i, sample := range samples {
+			binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+		}
+	default:
+		return nil, fmt.Errorf("unknown audio codec %d", format.Codec)
+	}
+	return DecodePCM(data, PCMFormat{
+		Channels:   format.Channels,
+		SampleRate: format.SampleRate,
+		SampleSize: sampleSize,
+		Unsigned:   sampleSize == 1,
+	})
+}
+
+// Position of the next read in file
+func (rvf *RVFReader) Offset() int64 {
+	return rvf.reader.pos
+}
+
+// Returns io.EOF after the last frame
+func (rvf *RVFReader) NextFrame() (RVFFrame, error) {
+	offset := rvf.reader.pos
+	if (rvf.size > 0 && offset >= rvf.framesEnd) || (rvf.last && rvf.Header.Frames < 0) {
+		return RVFFrame{}, io.EOF
+	}
+	if rvf.Header.Flags&CompressionFull == 0 {
+		data := make([]byte, rvf.Header.Width*rvf.Header.Height)
+		n, err := io.ReadFull(rvf.reader, data)
+		if n == 0 && err == io.EOF {
+			return RVFFrame{}, io.EOF
+		}
+		if err != nil {
+			return RVFFrame{}, truncated(err)
+		}
+		return RVFFrame{Offset: offset, Data: data}, nil
+	}
+
+	var size uint32
+	if err := binary.Read(rvf.reader, binary.LittleEndian, &size); err != nil {
+		if err == io.EOF {
+			return RVFFrame{}, io.EOF
+		}
+		return RVFFrame{}, truncated(err)
+	}
+	if size < 1+4 {
+		return RVFFrame{}, fmt.Errorf("wrong frame size %d", size)
+	}
+	if rvf.size > 0 && rvf.reader.pos+int64(size) > rvf.framesEnd {
+		return RVFFrame{}, fmt.Errorf("frame size %d exceeds the end of file: %w", size, ErrTruncated)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rvf.reader, data); err != nil {
+		return RVFFrame{}, truncated(err)
+	}
+	tail := binary.LittleEndian.Uint32(data[size-4:])
+	if tail != size {
+		return RVFFrame{}, fmt.Errorf("frame size %d doesn't match its tail %d", size, tail)
+	}
+	frame := RVFFrame{Offset: offset, Flags: data[0], Data: data[1 : size-4]}
+	if rvf.Header.Flags&Checksums != 0 {
+		if size < 1+4+4 {
+			return RVFFrame{}, fmt.Errorf("wrong frame size %d", size)
+		}
+		frame.Data = data[1 : size-8]
+		frame.Corrupted = binary.LittleEndian.Uint32(data[size-8:]) != frameChecksum(frame.Flags, frame.Data)
+	}
+	rvf.last = frame.Flags&FrameIsLast != 0
+	return frame, nil
+}
+
+// Moves to the offset in file, next read starts from it
+func (rvf *RVFReader) SetOffset(offset int64) error {
+	if _, err := rvf.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	rvf.reader.reader.Reset(rvf.file)
+	rvf.reader.pos = offset
+	rvf.last = false
+	return nil
+}
+
+func (rvf *RVFReader) readUint32At(offset int64) (uint32, bool) {
+	var data [4]byte
+	if _, err := rvf.file.ReadAt(data[:], offset); err != nil {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(data[:]), true
+}
+
+// Checks that frame at offset has known flags and its size matches the duplicate at the end
+func (rvf *RVFReader) isFrameAt(offset int64) (int64, bool) {
+	size, ok := rvf.readUint32At(offset)
+	minSize := uint32(1 + 4)
+	if rvf.Header.Flags&Checksums != 0 {
+		minSize += 4
+	}
+	if !ok || size < minSize || offset+4+int64(size) > rvf.framesEnd {
+		return 0, false
+	}
+	if tail, ok := rvf.readUint32At(offset + int64(size)); !ok || tail != size {
+		return 0, false
+	}
+	var flags [1]byte
+	if _, err := rvf.file.ReadAt(flags[:], offset+4); err != nil || flags[0]&^(FrameIsKeyframe|FrameIsFirst|FrameIsLast) != 0 {
+		return 0, false
+	}
+	return offset + 4 + int64(size), true
+}
+
+// Looks for the start of a frame after broken data using duplicated frame sizes.
+// Frame must be followed by another frame or the end of file. Returns io.EOF if nothing is found.
+func (rvf *RVFReader) FindFrame(from int64) (int64, error) {
+	if rvf.Header.Flags&CompressionFull == 0 {
+		return 0, errors.New("can't search frames in uncompressed file")
+	}
+	chunk := make([]byte, 64*1024)
+	for start := from; start+4 < rvf.framesEnd; start += int64(len(chunk) - 3) {
+		n, err := rvf.file.ReadAt(chunk, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := 0; i+4 <= n; i++ {
+			offset := start + int64(i)
+			// Quick check before reading the tail
+			if offset+4+int64(binary.LittleEndian.Uint32(chunk[i:])) > rvf.framesEnd {
+				continue
+			}
+			next, ok := rvf.isFrameAt(offset)
+			if !ok {
+				continue
+			}
+			if _, ok := rvf.isFrameAt(next); ok || next == rvf.framesEnd {
+				return offset, nil
+			}
+		}
+	}
+	return 0, io.EOF
+}
+
+func (rvf *RVFReader) Close() error {
+	return rvf.file.Close()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// What to do when audio and video durations differ
+type SyncPolicy int
+
+const (
+	SyncNone SyncPolicy = iota // keep both as is
+	SyncTrim                   // cut audio that is longer than video
+	SyncPad                    // add silence to audio that is shorter than video
+	SyncHold                   // hold the last frame while audio is longer than video
+)
+
+var syncPolicyNames = map[string]SyncPolicy{
+	"none": SyncNone,
+	"trim": SyncTrim,
+	"pad":  SyncPad,
+	"hold": SyncHold,
+}
+
+func FindSyncPolicy(name string) (SyncPolicy, error) {
+	policy, ok := syncPolicyNames[strings.ToLower(name)]
+	if !ok {
+		return SyncNone, fmt.Errorf("unknown sync policy \"%s\" (must be none, trim, pad or hold)", name)
+	}
+	return policy, nil
+}
+
+// Positive offset delays audio with silence, negative one cuts its beginning
+func (buffer *AudioBuffer) Shift(seconds float64) *AudioBuffer {
+	offset := int(math.Round(seconds * float64(buffer.SampleRate)))
+	if offset == 0 {
+		return buffer
+	}
+	result := &AudioBuffer{
+		SampleRate: buffer.SampleRate,
+		Bits:       buffer.Bits,
+		Channels:   make([][]float64, len(buffer.Channels)),
+	}
+	for ch, samples := range buffer.Channels {
+		if offset > 0 {
+			result.Channels[ch] = append(make([]float64, offset), samples...)
+		} else if -offset < len(samples) {
+			result.Channels[ch] = samples[-offset:]
+		} else {
+			result.Channels[ch] = []float64{}
+		}
+	}
+	return result
+}
+
+// Cuts audio or pads it with silence
+func (buffer *AudioBuffer) SetLength(length int) *AudioBuffer {
+	if length == buffer.Len() {
+		return buffer
+	}
+	result := &AudioBuffer{
+		SampleRate: buffer.SampleRate,
+		Bits:       buffer.Bits,
+		Channels:   make([][]float64, len(buffer.Channels)),
+	}
+	for ch, samples := range buffer.Channels {
+		if length < len(samples) {
+			result.Channels[ch] = samples[:length]
+		} else {
+			result.Channels[ch] = append(samples[:len(samples):len(samples)], make([]float64, length-len(samples))...)
+		}
+	}
+	return result
+}
+
+// Applies sync policy, prints a warning when durations differ by more than tolerance (seconds).
+// Audio of sources with unknown length can only be matched by holding the last frame.
+func SyncAudioVideo(source FrameSource, audio *AudioBuffer, frameRate float64, policy SyncPolicy, tolerance float64) (FrameSource, *AudioBuffer) {
+	audioDuration := audio.Duration()
+	audioFrames := int(math.Ceil(audioDuration*frameRate - 1e-9))
+	frames := source.FrameCount()
+	if frames < 0 {
+		switch policy {
+		case SyncHold:
+			return NewFrameHolder(source, audioFrames), audio
+		case SyncTrim, SyncPad:
+			fmt.Println("Warning: video length is unknown, audio duration is not changed")
+		}
+		return source, audio
+	}
+
+	videoDuration := float64(frames) / frameRate
+	diff := audioDuration - videoDuration
+	if math.Abs(diff) > tolerance {
+		relation := "longer"
+		if diff < 0 {
+			relation = "shorter"
+		}
+		fmt.Printf("Warning: audio (%.3f s) is %.3f s %s than video (%.3f s)\n", audioDuration, math.Abs(diff), relation, videoDuration)
+	}
+	videoLength := int(math.Round(videoDuration * float64(audio.SampleRate)))
+	switch {
+	case policy == SyncTrim && diff > 0:
+		fmt.Printf("Audio is trimmed to %.3f s\n", videoDuration)
+		audio = audio.SetLength(videoLength)
+	case policy == SyncPad && diff < 0:
+		fmt.Printf("Audio is padded to %.3f s\n", videoDuration)
+		audio = audio.SetLength(videoLength)
+	case policy == SyncHold && audioFrames > frames:
+		fmt.Printf("Last frame is held for %d frames\n", audioFrames-frames)
+		source = NewFrameHolder(source, audioFrames)
+	}
+	return source, audio
+}
+
+// Repeats the last frame of a source until it has at least minFrames frames
+type FrameHolder struct {
+	source    FrameSource
+	minFrames int
+	index     int
+	last      Frame
+	eof       bool
+}
+
+func NewFrameHolder(source FrameSource, minFrames int) *FrameHolder {
+	return &FrameHolder{
+		source:    source,
+		minFrames: minFrames,
+	}
+}
+
+func (holder *FrameHolder) Size() (int, int) {
+	return holder.source.Size()
+}
+
+func (holder *FrameHolder) FrameRate() float64 {
+	return holder.source.FrameRate()
+}
+
+func (holder *FrameHolder) FrameCount() int {
+	count := holder.source.FrameCount()
+	if count >= 0 && count < holder.minFrames {
+		return holder.minFrames
+	}
+	return count
+}
+
+func (holder *FrameHolder) Next() (Frame, error) {
+	if !holder.eof {
+		frame, err := holder.source.Next()
+		if err == nil {
+			holder.last = frame
+			holder.index++
+			return frame, nil
+		}
+		if err != io.EOF {
+			return Frame{}, err
+		}
+		holder.eof = true
+	}
+	// Empty source has nothing to hold
+	if holder.index >= holder.minFrames || holder.last.Data == nil {
+		return Frame{}, io.EOF
+	}
+	holder.index++
+	return holder.last, nil
+}
+
+func (holder *FrameHolder) Close() error {
+	return holder.source.Close()
+}
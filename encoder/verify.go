@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+type VerifyIssue struct {
+	Offset  int64 // in file, -1 if not related to a position
+	Frame   int   // -1 for header
+	Block   int   // -1 if not related to a block
+	Warning bool
+	Message string
+}
+
+func (issue VerifyIssue) String() string {
+	kind := "error"
+	if issue.Warning {
+		kind = "warning"
+	}
+	location := "header"
+	if issue.Frame >= 0 {
+		location = fmt.Sprintf("frame %d", issue.Frame)
+	}
+	if issue.Block >= 0 {
+		location += fmt.Sprintf(", block %d", issue.Block)
+	}
+	if issue.Offset >= 0 {
+		location += fmt.Sprintf(", offset 0x%X", issue.Offset)
+	}
+	return fmt.Sprintf("%s: %s: %s", kind, location, issue.Message)
+}
+
+type rvfVerifier struct {
+	issues  []VerifyIssue
+	palette int
+	blocks  int
+	frame   int
+	offset  int64
+}
+
+func (verifier *rvfVerifier) add(offset int64, block int, warning bool, format string, args ...interface{}) {
+	verifier.issues = append(verifier.issues, VerifyIssue{
+		Offset:  offset,
+		Frame:   verifier.frame,
+		Block:   block,
+		Warning: warning,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (verifier *rvfVerifier) checkColors(data []byte, offset int, block int) bool {
+	for i, color := range data {
+		if int(color) >= verifier.palette {
+			verifier.add(verifier.offset+int64(offset+i), block, false, "color %d is out of palette (%d colors)", color, verifier.palette)
+			return false
+		}
+	}
+	return true
+}
+
+// Checks packed frame data, offset is the position of data in file.
+// Only the first error of a frame is reported, the following ones are likely caused by it.
+func (verifier *rvfVerifier) checkFrame(data []byte, offset int64, keyframe bool) {
+	verifier.offset = offset
+	cacheCounts := [3]int{}
+	block := 0
+	for pos := 0; pos < len(data); {
+		op, err := ReadFrameOp(data, pos)
+		if err != nil {
+			verifier.add(offset+int64(pos), block, false, "%s", err)
+			return
+		}
+		opOffset := offset + int64(pos)
+		if block+op.Count > verifier.blocks {
+			verifier.add(opOffset, block, false, "%s of %d blocks overflows the frame (%d blocks)", opcodeNames[op.Code], op.Count, verifier.blocks)
+			return
+		}
+		payload := pos + op.Size - opPayloadSize(op.Code, op.Count)
+		ok := true
+		switch op.Code {
+		case ENC_SKIP, ENC_SKIP_LONG:
+			if keyframe {
+				verifier.add(opOffset, block, true, "skip in keyframe")
+			}
+		case ENC_REPEAT, ENC_REPEAT_LONG:
+			if block == 0 {
+				verifier.add(opOffset, block, false, "repeat without previous block")
+				ok = false
+			}
+		case ENC_SOLID, ENC_SOLID_LONG:
+			ok = verifier.checkColors(data[payload:payload+1], payload, block)
+		case ENC_PAL2, ENC_PAL4, ENC_PAL8:
+			colors, cache := encodingToColors(op.Code)
+			ok = verifier.checkColors(data[payload:payload+colors], payload, block)
+			if cacheCounts[cache] < 256 {
+				cacheCounts[cache]++
+			}
+		case ENC_PAL2_CACHE, ENC_PAL4_CACHE, ENC_PAL8_CACHE:
+			_, cache := encodingToColors(op.Code)
+			if index := int(data[payload]); index >= cacheCounts[cache] {
+				verifier.add(offset+int64(payload), block, false, "%s index %d refers to missing palette (%d in cache)", opcodeNames[op.Code], index, cacheCounts[cache])
+				ok = false
+			}
+		case ENC_RAW, ENC_RAW_LONG:
+			ok = verifier.checkColors(data[payload:pos+op.Size], payload, block)
+		}
+		if !ok {
+			return
+		}
+		block += op.Count
+		pos += op.Size
+	}
+	if block < verifier.blocks {
+		verifier.add(offset+int64(len(data)), block, true, "frame covers %d of %d blocks", block, verifier.blocks)
+	}
+}
+
+// Compares index with frames found in file
+func (verifier *rvfVerifier) checkIndex(index []RVFIndexEntry, frames []RVFIndexEntry) {
+	if len(index) != len(frames) {
+		verifier.add(-1, -1, false, "index has %d frames, file has %d", len(index), len(frames))
+	}
+	for i := 0; i < len(index) && i < len(frames); i++ {
+		if index[i] != frames[i] {
+			verifier.frame = i
+			verifier.add(frames[i].Offset, -1, false, "index entry (offset 0x%X, flags 0x%02X) doesn't match the frame", index[i].Offset, index[i].Flags)
+			verifier.frame = -1
+			return
+		}
+	}
+}
+
+// Walks the whole file, returns found problems. Error is returned only if file can't be opened.
+func VerifyRVF(filename string) ([]VerifyIssue, error) {
+	rvf, err := OpenRVF(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rvf.Close()
+
+	header := rvf.Header
+	verifier := &rvfVerifier{
+		palette: rvf.Palette.Len(),
+		blocks:  ((header.Width + 3) / 4) * ((header.Height + 3) / 4),
+		frame:   -1,
+	}
+	if header.Width <= 0 || header.Height <= 0 {
+		verifier.add(-1, -1, false, "wrong frame size %dx%d", header.Width, header.Height)
+	}
+	if !(header.FrameTime > 0) {
+		verifier.add(-1, -1, false, "wrong frame time %f", header.FrameTime)
+	}
+	if rvf.HeaderCorrupted {
+		verifier.add(0, -1, false, "header checksum mismatch")
+	}
+	if header.Flags&^(CompressionFull|AudioBlock|AudioStream|Checksums|Index|Metadata) != 0 {
+		verifier.add(-1, -1, false, "unknown flags 0x%02X", header.Flags)
+	}
+	if header.Flags&AudioStream != 0 {
+		verifier.add(-1, -1, false, "audio stream is not supported")
+	}
+	if header.Flags&Checksums != 0 && header.Flags&CompressionFull == 0 {
+		verifier.add(-1, -1, false, "checksums in uncompressed file")
+	}
+	if header.Flags&Index != 0 && header.Flags&CompressionFull == 0 {
+		verifier.add(-1, -1, false, "index in uncompressed file")
+	} else if header.Flags&Index != 0 && rvf.Index == nil {
+		verifier.add(-1, -1, false, "index is missing or broken")
+	}
+	if audio := header.Audio; audio != nil {
+		if audio.Channels < 1 || audio.Channels > 2 {
+			verifier.add(-1, -1, false, "wrong number of audio channels %d", audio.Channels)
+		} else if _, err := rvf.Audio(); err != nil {
+			verifier.add(-1, -1, false, "audio: %s", err)
+		} else if audio.Codec == AudioCodecPCM16 && len(rvf.AudioData)%(2*audio.Channels) != 0 {
+			verifier.add(-1, -1, true, "audio data size %d is not a multiple of sample size", len(rvf.AudioData))
+		}
+	}
+
+	compressed := header.Flags&CompressionFull != 0
+	unknownLength := header.Frames < 0
+	lastFound := false
+	frames := []RVFIndexEntry{}
+	count := 0
+	for {
+		verifier.frame = count
+		offset := rvf.Offset()
+		frame, err := rvf.NextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			verifier.add(offset, -1, false, "%s", err)
+			break
+		}
+		if count == header.Frames && !unknownLength {
+			verifier.add(offset, -1, false, "data after the last frame (header has %d frames)", header.Frames)
+			break
+		}
+		if compressed {
+			first := frame.Flags&FrameIsFirst != 0
+			last := frame.Flags&FrameIsLast != 0
+			if frame.Flags&^(FrameIsKeyframe|FrameIsFirst|FrameIsLast) != 0 {
+				verifier.add(frame.Offset+4, -1, false, "unknown frame flags 0x%02X", frame.Flags)
+			}
+			if first != (count == 0) {
+				verifier.add(frame.Offset+4, -1, false, "first frame flag is %t", first)
+			}
+			if count == 0 && frame.Flags&FrameIsKeyframe == 0 {
+				verifier.add(frame.Offset+4, -1, false, "first frame is not a keyframe")
+			}
+			if last != (count == header.Frames-1) && !unknownLength {
+				verifier.add(frame.Offset+4, -1, false, "last frame flag is %t", last)
+			}
+			lastFound = last
+			if frame.Corrupted {
+				verifier.add(frame.Offset, -1, false, "frame checksum mismatch")
+			} else {
+				verifier.checkFrame(frame.Data, frame.Offset+4+1, frame.Flags&FrameIsKeyframe != 0)
+			}
+		} else {
+			verifier.offset = frame.Offset
+			verifier.checkColors(frame.Data, 0, -1)
+		}
+		frames = append(frames, RVFIndexEntry{Offset: frame.Offset, Flags: frame.Flags})
+		count++
+	}
+	verifier.frame = -1
+	if count < header.Frames {
+		verifier.add(rvf.Offset(), -1, false, "file has %d frames, header has %d", count, header.Frames)
+	}
+	if unknownLength && compressed && !lastFound {
+		verifier.add(rvf.Offset(), -1, false, "stream of unknown length ends without last frame flag")
+	} else if unknownLength && rvf.Offset() < rvf.framesEnd {
+		verifier.add(rvf.Offset(), -1, true, "data after the last frame")
+	}
+	if rvf.Index != nil {
+		verifier.checkIndex(rvf.Index, frames)
+	}
+	return verifier.issues, nil
+}
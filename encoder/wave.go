@@ -1,77 +1,188 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
 type WAVfile struct {
-	Cannels     int
-	SampleRate  uint
-	IsHiQuality bool
-	Data        []byte
+	Cannels    int
+	SampleRate uint
+	Codec      uint8
+	BlockAlign int // ADPCM only
+	Data       []byte
 }
 
-func readChunkName(file *os.File) string {
-	chunkName := make([]byte, 4)
-	file.Read(chunkName)
-	return string(chunkName)
+const (
+	WaveFormatPCM        = 0x0001
+	WaveFormatFloat      = 0x0003
+	WaveFormatExtensible = 0xFFFE
+)
+
+// Tail of KSDATAFORMAT_SUBTYPE_* GUIDs, first two bytes are the format tag
+var waveSubFormatTail = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+var (
+	ErrNotWAV        = errors.New("not a RIFF WAVE file")
+	ErrNoFormatChunk = errors.New("no \"fmt \" chunk before \"data\" chunk")
+	ErrNoDataChunk   = errors.New("no \"data\" chunk")
+)
+
+type WAVFormat struct {
+	Tag           uint16 // WaveFormatPCM or WaveFormatFloat, extensible format is resolved to its sub-format
+	Channels      int
+	SampleRate    uint
+	BlockAlign    int
+	BitsPerSample int
+}
+
+type riffChunk struct {
+	name string
+	size uint32
 }
 
-func assertChunkName(file *os.File, name string) {
-	readedName := readChunkName(file)
-	if readedName != name {
-		panic(fmt.Errorf("wrong chunk name: \"%s\" (must be \"%s\")", readedName, name))
+func readRIFFChunk(reader io.Reader) (riffChunk, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return riffChunk{}, ErrTruncated
+		}
+		return riffChunk{}, err
 	}
+	return riffChunk{string(header[:4]), binary.LittleEndian.Uint32(header[4:])}, nil
 }
 
-func OpenWAV(filename string) *WAVfile {
-	file, err := os.Open(filename)
+// Chunk data is padded to even size
+func skipRIFFChunk(reader *bufio.Reader, chunk riffChunk) error {
+	size := int64(chunk.size) + int64(chunk.size&1)
+	skipped, err := io.CopyN(io.Discard, reader, size)
+	if err == io.EOF && skipped >= int64(chunk.size) {
+		// Missing padding byte of the last chunk
+		return nil
+	}
 	if err != nil {
-		panic(err)
+		return &ChunkError{"WAV", chunk.name, ErrTruncated}
 	}
-	defer file.Close()
+	return nil
+}
 
-	assertChunkName(file, "RIFF")
-	var fileSize, fmtSize uint32
-	binary.Read(file, binary.LittleEndian, &fileSize)
-	fileSize += 8
-	assertChunkName(file, "WAVE")
-	assertChunkName(file, "fmt ")
-	binary.Read(file, binary.LittleEndian, &fmtSize)
-	var formatTag, numChannels, numBits uint16
-	binary.Read(file, binary.LittleEndian, &formatTag)
-	if formatTag != 1 {
-		panic("File format must be PCM Integer")
+func parseWAVFormat(data []byte) (WAVFormat, error) {
+	if len(data) < 16 {
+		return WAVFormat{}, &ChunkError{"WAV", "fmt ", ErrTruncated}
+	}
+	format := WAVFormat{
+		Tag:           binary.LittleEndian.Uint16(data[0:]),
+		Channels:      int(binary.LittleEndian.Uint16(data[2:])),
+		SampleRate:    uint(binary.LittleEndian.Uint32(data[4:])),
+		BlockAlign:    int(binary.LittleEndian.Uint16(data[12:])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(data[14:])),
+	}
+	if format.Tag == WaveFormatExtensible {
+		// cbSize, valid bits, channel mask, sub-format GUID
+		if len(data) < 40 {
+			return WAVFormat{}, &ChunkError{"WAV", "fmt ", ErrTruncated}
+		}
+		subFormat := data[24:40]
+		if !bytes.Equal(subFormat[2:], waveSubFormatTail) {
+			return WAVFormat{}, &FormatError{"WAV", "unknown extensible sub-format"}
+		}
+		format.Tag = binary.LittleEndian.Uint16(subFormat)
 	}
-	binary.Read(file, binary.LittleEndian, &numChannels)
-	if numChannels > 2 {
-		panic("Number of channels must be 1 or 2")
+	if format.Channels == 0 || format.SampleRate == 0 || format.BlockAlign == 0 {
+		return WAVFormat{}, &ChunkError{"WAV", "fmt ", errors.New("zero channels, sample rate or block size")}
 	}
-	var sampleRate uint32
-	binary.Read(file, binary.LittleEndian, &sampleRate)
-	if sampleRate < 8000 {
-		panic("Sample rate must be at least 8 kHz")
+	return format, nil
+}
+
+// Walks RIFF chunks, skipping unknown ones, until "data" chunk
+func ReadWAV(reader io.Reader) (WAVFormat, []byte, error) {
+	breader := bufio.NewReader(reader)
+	var header [12]byte
+	if _, err := io.ReadFull(breader, header[:]); err != nil || string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return WAVFormat{}, nil, ErrNotWAV
 	}
-	file.Seek(6, 1)
-	binary.Read(file, binary.LittleEndian, &numBits)
-	if numBits != 8 && numBits != 16 {
-		panic("Wrong bit depth (must be 8 or 16)")
+
+	var format WAVFormat
+	hasFormat := false
+	for {
+		chunk, err := readRIFFChunk(breader)
+		if err == io.EOF {
+			return WAVFormat{}, nil, ErrNoDataChunk
+		}
+		if err != nil {
+			return WAVFormat{}, nil, err
+		}
+		switch chunk.name {
+		case "fmt ":
+			data := make([]byte, chunk.size)
+			if _, err := io.ReadFull(breader, data); err != nil {
+				return WAVFormat{}, nil, &ChunkError{"WAV", chunk.name, ErrTruncated}
+			}
+			if chunk.size&1 == 1 {
+				breader.ReadByte()
+			}
+			if format, err = parseWAVFormat(data); err != nil {
+				return WAVFormat{}, nil, err
+			}
+			hasFormat = true
+		case "data":
+			if !hasFormat {
+				return WAVFormat{}, nil, ErrNoFormatChunk
+			}
+			// Streamed recordings have unknown size (0xFFFFFFFF, or 0 in both RIFF and data headers),
+			// data is read to the end of file then. Size may also be too big in interrupted recordings.
+			riffSize := binary.LittleEndian.Uint32(header[4:8])
+			streamed := chunk.size == 0xFFFFFFFF || (chunk.size == 0 && (riffSize == 0 || riffSize == 0xFFFFFFFF))
+			var dataReader io.Reader = breader
+			if !streamed {
+				dataReader = io.LimitReader(breader, int64(chunk.size))
+			}
+			data, err := io.ReadAll(dataReader)
+			if err != nil {
+				return WAVFormat{}, nil, &ChunkError{"WAV", chunk.name, err}
+			}
+			data = data[:len(data)/format.BlockAlign*format.BlockAlign]
+			return format, data, nil
+		default:
+			if err := skipRIFFChunk(breader, chunk); err != nil {
+				return WAVFormat{}, nil, err
+			}
+		}
 	}
-	if fmtSize > 16 {
-		file.Seek(int64(fmtSize)-16, 1)
+}
+
+func LoadWAV(filename string) (*AudioBuffer, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
-	assertChunkName(file, "data")
-	var dataSize uint32
-	binary.Read(file, binary.LittleEndian, &dataSize)
-	data := make([]byte, dataSize)
-	file.Read(data)
+	defer file.Close()
 
-	return &WAVfile{
-		Cannels:     int(numChannels),
-		SampleRate:  uint(sampleRate),
-		IsHiQuality: numBits == 16,
-		Data:        data,
+	format, data, err := ReadWAV(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't load wav \"%s\": %w", filename, err)
+	}
+	if format.Tag != WaveFormatPCM && format.Tag != WaveFormatFloat {
+		return nil, fmt.Errorf("can't load wav \"%s\": %w", filename, &FormatError{"WAV", fmt.Sprintf("format tag 0x%04X (must be PCM integer or float)", format.Tag)})
+	}
+	if format.BlockAlign%format.Channels != 0 {
+		return nil, fmt.Errorf("can't load wav \"%s\": %w", filename, &FormatError{"WAV", fmt.Sprintf("block size %d for %d channels", format.BlockAlign, format.Channels)})
+	}
+	sampleSize := format.BlockAlign / format.Channels
+	buffer, err := DecodePCM(data, PCMFormat{
+		Channels:   format.Channels,
+		SampleRate: format.SampleRate,
+		SampleSize: sampleSize,
+		Float:      format.Tag == WaveFormatFloat,
+		Unsigned:   sampleSize == 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't load wav \"%s\": %w", filename, &FormatError{"WAV", err.Error()})
 	}
+	return buffer, nil
 }
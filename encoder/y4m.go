@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// YUV4MPEG2 stream reader (8 bit 4:2:0 and 4:4:4, BT.601)
+
+const y4mMagic = "YUV4MPEG2"
+
+type Y4MReader struct {
+	file       *os.File
+	reader     *bufio.Reader
+	width      int
+	height     int
+	frameRate  float64
+	chromaW    int
+	chromaH    int
+	chromaSub  int // 1 for 4:2:0, 0 for 4:4:4
+	fullRange  bool
+	frameIndex int
+	buffer     []byte
+}
+
+func OpenY4M(filename string) (*Y4MReader, error) {
+	result := &Y4MReader{}
+	if filename == "-" {
+		result.file = os.Stdin
+	} else {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		result.file = file
+	}
+	result.reader = bufio.NewReaderSize(result.file, 1<<20)
+	if err := result.readHeader(); err != nil {
+		result.Close()
+		return nil, fmt.Errorf("can't read y4m stream \"%s\": %w", filename, err)
+	}
+	return result, nil
+}
+
+func (y4m *Y4MReader) readHeader() error {
+	line, err := y4m.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	params := strings.Fields(line)
+	if len(params) == 0 || params[0] != y4mMagic {
+		return fmt.Errorf("wrong signature")
+	}
+	colorspace := "420jpeg"
+	for _, param := range params[1:] {
+		value := param[1:]
+		switch param[0] {
+		case 'W':
+			y4m.width, err = strconv.Atoi(value)
+		case 'H':
+			y4m.height, err = strconv.Atoi(value)
+		case 'F':
+			var num, den int
+			if _, err = fmt.Sscanf(value, "%d:%d", &num, &den); err == nil && num > 0 && den > 0 {
+				y4m.frameRate = float64(num) / float64(den)
+			}
+		case 'C':
+			colorspace = value
+		case 'I':
+			if value != "p" && value != "?" {
+				return fmt.Errorf("interlaced streams are not supported")
+			}
+		case 'X':
+			if strings.EqualFold(value, "COLORRANGE=FULL") {
+				y4m.fullRange = true
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("wrong header parameter \"%s\"", param)
+		}
+	}
+	if y4m.width <= 0 || y4m.height <= 0 {
+		return fmt.Errorf("wrong frame size %dx%d", y4m.width, y4m.height)
+	}
+	switch colorspace {
+	case "420", "420jpeg", "420paldv", "420mpeg2":
+		y4m.chromaSub = 1
+	case "444":
+		y4m.chromaSub = 0
+	default:
+		return fmt.Errorf("unsupported colorspace \"%s\" (must be 420 or 444)", colorspace)
+	}
+	y4m.chromaW = (y4m.width + y4m.chromaSub) >> y4m.chromaSub
+	y4m.chromaH = (y4m.height + y4m.chromaSub) >> y4m.chromaSub
+	y4m.buffer = make([]byte, y4m.width*y4m.height+2*y4m.chromaW*y4m.chromaH)
+	return nil
+}
+
+func (y4m *Y4MReader) Size() (int, int) {
+	return y4m.width, y4m.height
+}
+
+func (y4m *Y4MReader) FrameRate() float64 {
+	return y4m.frameRate
+}
+
+func (y4m *Y4MReader) FrameCount() int {
+	return -1
+}
+
+func (y4m *Y4MReader) Next() (Frame, error) {
+	line, err := y4m.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return Frame{}, io.EOF
+	}
+	if err != nil {
+		return Frame{}, fmt.Errorf("y4m frame %d: %w", y4m.frameIndex, err)
+	}
+	if !strings.HasPrefix(line, "FRAME") {
+		return Frame{}, fmt.Errorf("y4m frame %d: wrong frame header", y4m.frameIndex)
+	}
+	if _, err := io.ReadFull(y4m.reader, y4m.buffer); err != nil {
+		return Frame{}, fmt.Errorf("y4m frame %d: %w", y4m.frameIndex, err)
+	}
+	y4m.frameIndex++
+
+	lumaSize := y4m.width * y4m.height
+	chromaSize := y4m.chromaW * y4m.chromaH
+	planeY := y4m.buffer[:lumaSize]
+	planeU := y4m.buffer[lumaSize : lumaSize+chromaSize]
+	planeV := y4m.buffer[lumaSize+chromaSize:]
+
+	result := make([]IntColor, lumaSize)
+	for y := 0; y < y4m.height; y++ {
+		for x := 0; x < y4m.width; x++ {
+			chroma := (y>>y4m.chromaSub)*y4m.chromaW + x>>y4m.chromaSub
+			result[y*y4m.width+x] = y4m.toRGB(planeY[y*y4m.width+x], planeU[chroma], planeV[chroma])
+		}
+	}
+	return Frame{result, y4m.width, y4m.height}, nil
+}
+
+func (y4m *Y4MReader) toRGB(y byte, u byte, v byte) IntColor {
+	luma := float64(y)
+	cb := float64(u) - 128
+	cr := float64(v) - 128
+	if !y4m.fullRange {
+		luma = (luma - 16) * 255 / 219
+		cb = cb * 255 / 224
+		cr = cr * 255 / 224
+	}
+	return FloatColor{
+		R: (luma + 1.402*cr) / 255,
+		G: (luma - 0.344136*cb - 0.714136*cr) / 255,
+		B: (luma + 1.772*cb) / 255,
+	}.ToIntColor()
+}
+
+func (y4m *Y4MReader) Close() error {
+	if y4m.file == os.Stdin {
+		return nil
+	}
+	return y4m.file.Close()
+}
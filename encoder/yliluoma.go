@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sort"
+)
+
+// Yliluoma's arbitrary-palette positional dithering (https://bisqwit.iki.fi/story/howto/dither/jy/)
+//   1 - mix of two colors with the best ratio, penalized for mixing distant colors
+//   2 - greedy mix of pattern.Order colors, one color at a time
+//   3 - same as 2, but tests adding a color in amounts of powers of two
+
+// Only that many colors closest to the pixel are tested for mixing (pairs in 1, mix members in 2 and 3)
+const yliluomaPairCandidates = 16
+const yliluomaMixCandidates = 32
+
+type YliluomaDithering struct {
+	algorithm int
+	width     int
+	height    int
+	source    *Pattern
+	pattern   *Pattern
+	fdata     []FloatColor
+	workers   int
+	rangeSize int
+	pc        *PalComp
+}
+
+func NewYliluomaDithering(algorithm int, pattern *Pattern, workers int) *YliluomaDithering {
+	if workers < 0 {
+		workers = runtime.NumCPU()
+	}
+	return &YliluomaDithering{
+		algorithm: algorithm,
+		source:    pattern,
+		workers:   workers,
+	}
+}
+
+func (dither *YliluomaDithering) Init(pal Palette, pc *PalComp, width int, height int) {
+	dither.width = width
+	dither.height = height
+	dither.pattern = dither.source.Reshape(width, height)
+	dither.fdata = make([]FloatColor, width*height)
+	dither.rangeSize = width * height / dither.workers
+	dither.pc = pc
+}
+
+func (dither *YliluomaDithering) Process(imageData []IntColor, pal Palette) []int {
+	idata := make([]int, dither.width*dither.height)
+
+	for i := range dither.fdata {
+		dither.fdata[i] = dither.pc.SourceColor(imageData[i])
+	}
+
+	runWorkers(dither.workers, dither.rangeSize, len(idata), func(rangeStart int, rangeEnd int) {
+		plan := make([]int, dither.pattern.Order)
+		nearest := make([]int, 0, yliluomaMixCandidates)
+		dists := make([]float64, 0, yliluomaMixCandidates)
+		for p := rangeStart; p < rangeEnd; p++ {
+			if dither.algorithm == 1 {
+				idata[p] = dither.mixTwo(dither.fdata[p], dither.pattern.Data[p], nearest, dists)
+			} else {
+				dither.mixMany(dither.fdata[p], plan, nearest, dists)
+				idata[p] = plan[dither.pattern.Data[p]]
+			}
+		}
+	})
+
+	return idata
+}
+
+// Bilinear form of the color difference: diff(a, b) = diffProduct(a-b, a-b)
+func diffProduct(v FloatColor, w FloatColor) float64 {
+	return (v.R*w.R*0.299+v.G*w.G*0.587+v.B*w.B*0.114)*0.75 + v.Luma()*w.Luma()
+}
+
+// Keeps the closest colors in a small sorted list
+func (dither *YliluomaDithering) nearestColors(color FloatColor, count int, result []int, dists []float64) []int {
+	luma := color.Luma()
+	result = result[:0]
+	dists = dists[:0]
+	for i := range dither.pc.floatpal {
+		dist := dither.pc.colorDiff(color, luma, i)
+		if len(result) == count && dist >= dists[count-1] {
+			continue
+		}
+		if len(result) < count {
+			result = append(result, i)
+			dists = append(dists, dist)
+		}
+		pos := len(result) - 1
+		for pos > 0 && dists[pos-1] > dist {
+			result[pos] = result[pos-1]
+			dists[pos] = dists[pos-1]
+			pos--
+		}
+		result[pos] = i
+		dists[pos] = dist
+	}
+	return result
+}
+
+func (dither *YliluomaDithering) mixTwo(color FloatColor, threshold int, nearest []int, dists []float64) int {
+	order := float64(dither.pattern.Order)
+	nearest = dither.nearestColors(color, yliluomaPairCandidates, nearest, dists)
+
+	bestPenalty := math.MaxFloat64
+	bestFirst, bestSecond, bestRatio := nearest[0], nearest[0], 0
+	for i, first := range nearest {
+		c1 := dither.pc.floatpal[first]
+		for _, second := range nearest[i:] {
+			c2 := dither.pc.floatpal[second]
+			delta := FloatColor{c2.R - c1.R, c2.G - c1.G, c2.B - c1.B}
+			// Penalty is quadratic, so the best ratio is the projection of the color onto the c1-c2 line
+			ratio := 0
+			norm := diffProduct(delta, delta)
+			if norm > 0 {
+				offset := FloatColor{color.R - c1.R, color.G - c1.G, color.B - c1.B}
+				ratio = int(math.Round(diffProduct(offset, delta) / norm * order))
+				if ratio < 0 {
+					ratio = 0
+				}
+				if ratio > dither.pattern.Order {
+					ratio = dither.pattern.Order
+				}
+			}
+			part := float64(ratio) / order
+			mix := FloatColor{c1.R + delta.R*part, c1.G + delta.G*part, c1.B + delta.B*part}
+			penalty := color.Difference(mix) + dither.pc.CompareColors(first, second)*0.1*(math.Abs(part-0.5)+0.5)
+			if penalty < bestPenalty {
+				bestPenalty = penalty
+				bestFirst, bestSecond, bestRatio = first, second, ratio
+			}
+		}
+	}
+	if threshold < bestRatio {
+		return bestSecond
+	}
+	return bestFirst
+}
+
+func (dither *YliluomaDithering) mixMany(color FloatColor, plan []int, nearest []int, dists []float64) {
+	nearest = dither.nearestColors(color, yliluomaMixCandidates, nearest, dists)
+	luma := color.Luma()
+	soFar := FloatColor{0, 0, 0}
+	soFarLuma := 0.0
+	count := 0
+	for count < len(plan) {
+		maxAmount := 1
+		if dither.algorithm == 3 && count > 1 {
+			maxAmount = count
+		}
+		if maxAmount > len(plan)-count {
+			maxAmount = len(plan) - count
+		}
+		chosen := 0
+		chosenAmount := 1
+		leastPenalty := math.MaxFloat64
+		for _, index := range nearest {
+			add := dither.pc.floatpal[index]
+			addLuma := dither.pc.lumas[index]
+			for amount := 1; amount <= maxAmount; amount *= 2 {
+				a := float64(amount)
+				total := float64(count + amount)
+				diffR := color.R - (soFar.R+add.R*a)/total
+				diffG := color.G - (soFar.G+add.G*a)/total
+				diffB := color.B - (soFar.B+add.B*a)/total
+				diffLuma := luma - (soFarLuma+addLuma*a)/total
+				penalty := (diffR*diffR*0.299+diffG*diffG*0.587+diffB*diffB*0.114)*0.75 + diffLuma*diffLuma
+				if penalty < leastPenalty {
+					leastPenalty = penalty
+					chosen = index
+					chosenAmount = amount
+				}
+			}
+		}
+		for i := 0; i < chosenAmount; i++ {
+			plan[count] = chosen
+			count++
+		}
+		chosenColor := dither.pc.floatpal[chosen]
+		soFar.R += chosenColor.R * float64(chosenAmount)
+		soFar.G += chosenColor.G * float64(chosenAmount)
+		soFar.B += chosenColor.B * float64(chosenAmount)
+		soFarLuma += dither.pc.lumas[chosen] * float64(chosenAmount)
+	}
+	sort.Slice(plan, func(i, j int) bool { return dither.pc.lumas[plan[i]] < dither.pc.lumas[plan[j]] })
+}
@@ -194,10 +194,69 @@ uint8_t* palcache_get_pal(PaletteCache* cache, int index) {
 
 //== DECODER ==//
 
-Decoder* dec_new(int frame_width, int frame_height) {
+static size_t op_payload_size(uint8_t block_type, int block_length) {
+    switch (block_type) {
+        case ENC_SOLID:
+        case ENC_SOLID_LONG:
+            return 1;
+        case ENC_PAL2:
+            return 2 + 2 * block_length;
+        case ENC_PAL2_CACHE:
+            return 1 + 2 * block_length;
+        case ENC_PAL4:
+            return 4 + 4 * block_length;
+        case ENC_PAL4_CACHE:
+            return 1 + 4 * block_length;
+        case ENC_PAL8:
+            return 8 + 6 * block_length;
+        case ENC_PAL8_CACHE:
+            return 1 + 6 * block_length;
+        case ENC_RAW:
+        case ENC_RAW_LONG:
+            return 16 * block_length;
+    }
+    return 0;
+}
+
+// Reads opcode and length, checks that the payload fits the buffer and blocks fit the frame
+static int read_op(Decoder* dec, int* ind, int bi, uint8_t* block_type, int* block_length) {
+    uint8_t* buffer = dec->buffer;
+    *block_type = buffer[*ind] & 0b11110000;
+    if (*block_type == ENC_SOLID_SEP || *block_type == ENC_SOLID_SEP_LONG) {
+        return -1;
+    }
+    if (*block_type == ENC_RAW_LONG || *block_type == ENC_REPEAT_LONG || *block_type == ENC_SKIP_LONG || *block_type == ENC_SOLID_LONG) {
+        if (*ind + 1 >= dec->buffer_size) {
+            return -1;
+        }
+        *block_length = ((int)(buffer[*ind] & 0b1111) << 8) + buffer[*ind + 1];
+        (*ind)++;
+    } else {
+        *block_length = buffer[*ind] & 0b1111;
+    }
+    *block_length += 1;
+    (*ind)++;
+    if (*ind + op_payload_size(*block_type, *block_length) > dec->buffer_size ||
+        bi + *block_length > dec->blocks_width * dec->blocks_height) {
+        return -1;
+    }
+    return 0;
+}
+
+static int check_colors(Decoder* dec, uint8_t* colors, size_t count) {
+    for (size_t i = 0; i < count; i++) {
+        if (colors[i] >= dec->colors) {
+            return -1;
+        }
+    }
+    return 0;
+}
+
+Decoder* dec_new(int frame_width, int frame_height, int colors) {
     Decoder* dec = malloc(sizeof(Decoder));
     dec->width = frame_width;
     dec->height = frame_height;
+    dec->colors = colors;
 
     dec->buffer = NULL;
     dec->buffer_size = 0;
@@ -226,23 +285,19 @@ void dec_free(Decoder** dec) {
     *dec = NULL;
 }
 
-static decode_blocks(Decoder* dec) {
+// Returns -1 on broken data, decoded blocks are left partially updated
+static int decode_blocks(Decoder* dec) {
     int ind = 0;
     int bi = 0;
     palcache_reset(&dec->cache[0]);
     palcache_reset(&dec->cache[1]);
     palcache_reset(&dec->cache[2]);
     while (ind < dec->buffer_size) {
-        uint8_t block_type = dec->buffer[ind] & 0b11110000;
-        int block_length = 0;
-        if (block_type == ENC_RAW_LONG || block_type == ENC_REPEAT_LONG || block_type == ENC_SKIP_LONG || block_type == ENC_SOLID_LONG || block_type == ENC_SOLID_SEP_LONG) {
-            block_length = ((int)(dec->buffer[ind] & 0b1111) << 8) + dec->buffer[ind + 1];
-            ind++;
-        } else {
-            block_length = dec->buffer[ind] & 0b1111;
+        uint8_t block_type;
+        int block_length;
+        if (read_op(dec, &ind, bi, &block_type, &block_length) != 0) {
+            return -1;
         }
-        block_length += 1;
-        ind++;
         switch (block_type) {
             case ENC_SKIP:
             case ENC_SKIP_LONG:
@@ -250,6 +305,9 @@ static decode_blocks(Decoder* dec) {
                 break;
             case ENC_REPEAT:
             case ENC_REPEAT_LONG: {
+                if (bi == 0) {
+                    return -1;
+                }
                 int src = bi - 1;
                 for (int i = 0; i < block_length; i++) {
                     memcpy(&dec->blocks[bi], &dec->blocks[src], sizeof(Block));
@@ -258,6 +316,9 @@ static decode_blocks(Decoder* dec) {
             } break;
             case ENC_SOLID:
             case ENC_SOLID_LONG: {
+                if (check_colors(dec, &dec->buffer[ind], 1) != 0) {
+                    return -1;
+                }
                 int color = dec->buffer[ind++];
                 for (int i = 0; i < block_length; i++) {
                     memset(&dec->blocks[bi], color, sizeof(Block));
@@ -269,10 +330,16 @@ static decode_blocks(Decoder* dec) {
                 uint8_t* pal;
                 if (block_type == ENC_PAL2) {
                     pal = &dec->buffer[ind];
+                    if (check_colors(dec, pal, 2) != 0) {
+                        return -1;
+                    }
                     ind += 2;
                     palcache_add(&dec->cache[0], pal);
                 } else {
                     int palind = dec->buffer[ind++];
+                    if (palind >= dec->cache[0].count) {
+                        return -1;
+                    }
                     pal = palcache_get_pal(&dec->cache[0], palind);
                 }
                 uint8_t block[16];
@@ -290,10 +357,16 @@ static decode_blocks(Decoder* dec) {
                 uint8_t* pal;
                 if (block_type == ENC_PAL4) {
                     pal = &dec->buffer[ind];
+                    if (check_colors(dec, pal, 4) != 0) {
+                        return -1;
+                    }
                     ind += 4;
                     palcache_add(&dec->cache[1], pal);
                 } else {
                     int palind = dec->buffer[ind++];
+                    if (palind >= dec->cache[1].count) {
+                        return -1;
+                    }
                     pal = palcache_get_pal(&dec->cache[1], palind);
                 }
                 uint8_t block[16];
@@ -311,10 +384,16 @@ static decode_blocks(Decoder* dec) {
                 uint8_t* pal;
                 if (block_type == ENC_PAL8) {
                     pal = &dec->buffer[ind];
+                    if (check_colors(dec, pal, 8) != 0) {
+                        return -1;
+                    }
                     ind += 8;
                     palcache_add(&dec->cache[2], pal);
                 } else {
                     int palind = dec->buffer[ind++];
+                    if (palind >= dec->cache[2].count) {
+                        return -1;
+                    }
                     pal = palcache_get_pal(&dec->cache[2], palind);
                 }
                 uint8_t block[16];
@@ -329,6 +408,9 @@ static decode_blocks(Decoder* dec) {
             } break;
             case ENC_RAW:
             case ENC_RAW_LONG:
+                if (check_colors(dec, &dec->buffer[ind], 16 * block_length) != 0) {
+                    return -1;
+                }
                 for (int i = 0; i < block_length; i++) {
                     memcpy(&dec->blocks[bi], &dec->buffer[ind], sizeof(Block));
                     bi++;
@@ -337,25 +419,21 @@ static decode_blocks(Decoder* dec) {
                 break;
         }
     }
+    return 0;
 }
 
-static decode_blocks_debug(Decoder* dec) {
+static int decode_blocks_debug(Decoder* dec) {
     int ind = 0;
     int bi = 0;
     palcache_reset(&dec->cache[0]);
     palcache_reset(&dec->cache[1]);
     palcache_reset(&dec->cache[2]);
     while (ind < dec->buffer_size) {
-        uint8_t block_type = dec->buffer[ind] & 0b11110000;
-        int block_length = 0;
-        if (block_type == ENC_RAW_LONG || block_type == ENC_REPEAT_LONG || block_type == ENC_SKIP_LONG || block_type == ENC_SOLID_LONG || block_type == ENC_SOLID_SEP_LONG) {
-            block_length = ((int)(dec->buffer[ind] & 0b1111) << 8) + dec->buffer[ind + 1];
-            ind++;
-        } else {
-            block_length = dec->buffer[ind] & 0b1111;
+        uint8_t block_type;
+        int block_length;
+        if (read_op(dec, &ind, bi, &block_type, &block_length) != 0) {
+            return -1;
         }
-        block_length += 1;
-        ind++;
         for (int i = 0; i < block_length; i++) {
             memset(&dec->blocks[bi], block_type >> 4, sizeof(Block));
             bi++;
@@ -398,6 +476,7 @@ static decode_blocks_debug(Decoder* dec) {
                 break;
         }
     }
+    return 0;
 }
 
 static unwrap_pixels(Decoder* dec, uint8_t* dst) {
@@ -413,7 +492,7 @@ static unwrap_pixels(Decoder* dec, uint8_t* dst) {
         }
 }
 
-void dec_decode(Decoder* dec, FILE* file, uint32_t length, uint8_t* dest, int debug) {
+uint8_t* dec_read(Decoder* dec, FILE* file, uint32_t length) {
     if (length > dec->buffer_capacity) {
         free(dec->buffer);
         dec->buffer = malloc(length);
@@ -421,10 +500,24 @@ void dec_decode(Decoder* dec, FILE* file, uint32_t length, uint8_t* dest, int de
     }
     dec->buffer_size = length;
     fread(dec->buffer, length, 1, file);
+    return dec->buffer;
+}
+
+int dec_decode(Decoder* dec, FILE* file, uint32_t length, uint8_t* dest, int debug) {
+    dec_read(dec, file, length);
+    return dec_decode_buffer(dec, dest, debug);
+}
+
+int dec_decode_buffer(Decoder* dec, uint8_t* dest, int debug) {
+    int result;
     if (debug) {
-        decode_blocks_debug(dec);
+        result = decode_blocks_debug(dec);
     } else {
-        decode_blocks(dec);
+        result = decode_blocks(dec);
+    }
+    if (result != 0) {
+        return result;
     }
     unwrap_pixels(dec, dest);
+    return 0;
 }
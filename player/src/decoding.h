@@ -16,6 +16,7 @@ typedef struct PaletteCache {
 typedef struct Decoder {
     int width;
     int height;
+    int colors;
     uint8_t* buffer;
     size_t buffer_size;
     size_t buffer_capacity;
@@ -28,8 +29,12 @@ typedef struct Decoder {
     PaletteCache cache[3];
 } Decoder;
 
-Decoder* dec_new(int frame_width, int frame_height);
+Decoder* dec_new(int frame_width, int frame_height, int colors);
 void dec_free(Decoder** dec);
-void dec_decode(Decoder* dec, FILE* file, uint32_t length, uint8_t* dest, int debug);
+// Returns -1 if frame data is broken, dest is not changed then
+int dec_decode(Decoder* dec, FILE* file, uint32_t length, uint8_t* dest, int debug);
+// Reads frame data into internal buffer, to be decoded with dec_decode_buffer
+uint8_t* dec_read(Decoder* dec, FILE* file, uint32_t length);
+int dec_decode_buffer(Decoder* dec, uint8_t* dest, int debug);
 
 #endif
\ No newline at end of file
@@ -156,12 +156,16 @@ int main(int argc, char *argv[]) {
         return 0;
     }
 
-    printf("colors: %d\nframe size: %dx%d\nframes total:%d\nfps: %f\n",
+    printf("colors: %d\nframe size: %dx%d\n",
            video->colors,
            video->width,
-           video->height,
-           video->length,
-           1.0f / video->frame_time);
+           video->height);
+    if (video->length >= 0) {
+        printf("frames total:%d\n", video->length);
+    } else {
+        printf("frames total: unknown\n");
+    }
+    printf("fps: %f\n", 1.0f / video->frame_time);
 
     screen_width = video->width;
     screen_height = video->height;
@@ -275,6 +279,9 @@ int main(int argc, char *argv[]) {
     SDL_DestroyRenderer(renderer);
     SDL_DestroyWindow(window);
     SDL_Quit();
+    if (video->concealed_frames > 0) {
+        rvf_print_stats(video);
+    }
     rvf_close(&video);
     return 0;
 }
\ No newline at end of file
@@ -1,17 +1,107 @@
 #include "rvf_decode.h"
 #include <stdlib.h>
+#include <string.h>
 
 #define COMPRESSION_NONE 0b00000000
 #define COMPRESSION_FULL 0b00000001
 #define AUDIO_BLOCK 0b00000010
 #define AUDIO_STREAM 0b00000100
+#define CHECKSUMS 0b00001000
+#define INDEX 0b00010000
+#define METADATA 0b00100000
 #define FRAME_REGULAR 0b00000000
 #define FRAME_IS_KEYFRAME 0b00000001
 #define FRAME_IS_FIRST 0b00000010
 #define FRAME_IS_LAST 0b00000100
 
+#define AUDIO_PCM8 0
+#define AUDIO_PCM16 1
+#define AUDIO_ADPCM 2
+
+#define UNKNOWN_FRAME_COUNT 0xFFFFFFFF
+
 static int debug = 0;
 
+static uint32_t crc32_table[256];
+
+static uint32_t crc32_update(uint32_t crc, const uint8_t* data, size_t size) {
+    if (crc32_table[1] == 0) {
+        for (uint32_t i = 0; i < 256; i++) {
+            uint32_t c = i;
+            for (int k = 0; k < 8; k++) {
+                c = (c & 1) ? 0xEDB88320 ^ (c >> 1) : c >> 1;
+            }
+            crc32_table[i] = c;
+        }
+    }
+    crc = ~crc;
+    for (size_t i = 0; i < size; i++) {
+        crc = crc32_table[(crc ^ data[i]) & 0xFF] ^ (crc >> 8);
+    }
+    return ~crc;
+}
+
+static const int ima_step_table[89] = {
+    7, 8, 9, 10, 11, 12, 13, 14, 16, 17,
+    19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+    50, 55, 60, 66, 73, 80, 88, 97, 107, 118,
+    130, 143, 157, 173, 190, 209, 230, 253, 279, 307,
+    337, 371, 408, 449, 494, 544, 598, 658, 724, 796,
+    876, 963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066,
+    2272, 2499, 2749, 3024, 3327, 3660, 4026, 4428, 4871, 5358,
+    5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487, 12635, 13899,
+    15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767};
+
+static const int ima_index_table[8] = {-1, -1, -1, -1, 2, 4, 6, 8};
+
+static int16_t ima_decode(int* predictor, int* index, uint8_t nibble) {
+    int step = ima_step_table[*index];
+    int diff = step >> 3;
+    if (nibble & 4) diff += step;
+    if (nibble & 2) diff += step >> 1;
+    if (nibble & 1) diff += step >> 2;
+    *predictor += (nibble & 8) ? -diff : diff;
+    if (*predictor > 32767) *predictor = 32767;
+    if (*predictor < -32768) *predictor = -32768;
+    *index += ima_index_table[nibble & 7];
+    if (*index < 0) *index = 0;
+    if (*index > 88) *index = 88;
+    return (int16_t)*predictor;
+}
+
+// IMA ADPCM blocks (WAV 0x0011 layout) to 16 bit PCM
+static int16_t* adpcm_decode(const uint8_t* data, size_t size, int channels, int block_align, size_t* samples_size) {
+    int predictor[2], index[2];
+    size_t max_samples = (size / block_align + 1) * ((block_align - 4 * channels) * 2 + channels);
+    int16_t* result = malloc(max_samples * sizeof(int16_t));
+    size_t pos = 0;
+    for (size_t start = 0; start < size; start += block_align) {
+        size_t block_size = size - start < (size_t)block_align ? size - start : (size_t)block_align;
+        const uint8_t* block = data + start;
+        if (block_size < (size_t)(4 * channels)) {
+            break;
+        }
+        for (int ch = 0; ch < channels; ch++) {
+            predictor[ch] = (int16_t)(block[ch * 4] | (block[ch * 4 + 1] << 8));
+            index[ch] = block[ch * 4 + 2] > 88 ? 88 : block[ch * 4 + 2];
+            result[pos++] = (int16_t)predictor[ch];
+        }
+        size_t groups = (block_size - 4 * channels) / (4 * channels);
+        for (size_t g = 0; g < groups; g++) {
+            for (int ch = 0; ch < channels; ch++) {
+                const uint8_t* group = block + 4 * channels + (g * channels + ch) * 4;
+                for (int i = 0; i < 8; i++) {
+                    uint8_t nibble = (group[i / 2] >> (4 * (i % 2))) & 0x0F;
+                    result[pos + (g * 8 + i) * channels + ch] = ima_decode(&predictor[ch], &index[ch], nibble);
+                }
+            }
+        }
+        pos += groups * 8 * channels;
+    }
+    *samples_size = pos * sizeof(int16_t);
+    return result;
+}
+
 RVF_File* rvf_open(const char* filename) {
     RVF_File* result = malloc(sizeof(RVF_File));
     result->file = fopen(filename, "rb");
@@ -25,7 +115,8 @@ RVF_File* rvf_open(const char* filename) {
     }
     uint8_t version = 0;
     fread(&version, 1, 1, result->file);
-    if (version != 3) {
+    // Version 3 has no ADPCM audio, checksums, index and metadata
+    if (version != 3 && version != 4) {
         printf("Wrong file format version.");
         free(result);
         return NULL;
@@ -38,24 +129,51 @@ RVF_File* rvf_open(const char* filename) {
     fread(&length, 4, 1, result->file);
     fread(&frame_time, 4, 1, result->file);
     fread(&flags, 1, 1, result->file);
+    if (version < 4 && (flags & (CHECKSUMS | INDEX | METADATA))) {
+        printf("Wrong file format version.");
+        fclose(result->file);
+        free(result);
+        return NULL;
+    }
     result->width = width;
     result->height = height;
-    result->length = length;
+    result->length = length == UNKNOWN_FRAME_COUNT ? -1 : (int)length;
     result->frame_time = frame_time;
     result->is_compressed = (flags & COMPRESSION_FULL) > 0;
+    result->has_checksums = (flags & CHECKSUMS) > 0;
 
     result->audio = NULL;
     if (flags & AUDIO_BLOCK || flags & AUDIO_STREAM) {
         uint32_t frequency, buffer_size;
-        uint8_t channels, quality;
+        uint8_t channels, codec;
+        uint16_t block_align = 0;
         fread(&channels, 1, 1, result->file);
         fread(&frequency, 4, 1, result->file);
-        fread(&quality, 1, 1, result->file);
+        fread(&codec, 1, 1, result->file);
+        if (codec == AUDIO_ADPCM) {
+            fread(&block_align, 2, 1, result->file);
+        }
+        if (codec > AUDIO_ADPCM || (codec == AUDIO_ADPCM && version < 4) || channels < 1 || channels > 2 ||
+            (codec == AUDIO_ADPCM && (block_align <= 4 * channels || (block_align - 4 * channels) % (4 * channels) != 0))) {
+            printf("Unsupported audio format.");
+            fclose(result->file);
+            free(result);
+            return NULL;
+        }
 
         result->audio = malloc(sizeof(RVF_Audio));
         result->audio->channels = channels;
         result->audio->frequency = frequency;
-        result->audio->bit_depth = quality ? 16 : 8;
+        result->audio->codec = codec;
+        result->audio->block_align = block_align;
+        result->audio->bit_depth = codec == AUDIO_PCM8 ? 8 : 16;
+    }
+
+    // Metadata is not used by the player
+    if (flags & METADATA) {
+        uint32_t metadata_size;
+        fread(&metadata_size, 4, 1, result->file);
+        fseek(result->file, metadata_size, SEEK_CUR);
     }
 
     uint8_t color_count;
@@ -65,12 +183,32 @@ RVF_File* rvf_open(const char* filename) {
     result->palette = calloc(result->colors, sizeof(RVF_Color));
     fread(result->palette, sizeof(RVF_Color), result->colors, result->file);
 
+    if (result->has_checksums) {
+        // Header and palette are read again for checksum
+        long header_size = ftell(result->file);
+        uint8_t* header = malloc(header_size);
+        uint32_t stored_crc = 0;
+        fseek(result->file, 0, SEEK_SET);
+        fread(header, header_size, 1, result->file);
+        fread(&stored_crc, 4, 1, result->file);
+        if (crc32_update(0, header, header_size) != stored_crc) {
+            printf("Header checksum mismatch.\n");
+        }
+        free(header);
+    }
+
     if (flags & AUDIO_BLOCK) {
         uint32_t buffer_size;
         fread(&buffer_size, 4, 1, result->file);
         result->audio->buffer_size = buffer_size;
         result->audio->buffer = malloc(buffer_size);
         fread(result->audio->buffer, buffer_size, 1, result->file);
+        if (result->audio->codec == AUDIO_ADPCM) {
+            char* encoded = result->audio->buffer;
+            result->audio->buffer = (char*)adpcm_decode((uint8_t*)encoded, buffer_size, result->audio->channels,
+                                                        result->audio->block_align, &result->audio->buffer_size);
+            free(encoded);
+        }
     }
 
     result->frames_offset = ftell(result->file);
@@ -79,7 +217,34 @@ RVF_File* rvf_open(const char* filename) {
     result->frame_size = result->width * result->height;
     result->data = malloc(result->frame_size);
 
-    result->decoder = dec_new(result->width, result->height);
+    result->decoder = dec_new(result->width, result->height, result->colors);
+
+    fseek(result->file, 0, SEEK_END);
+    result->file_size = ftell(result->file);
+    result->frames_end = result->file_size;
+    if (flags & INDEX) {
+        // Index is not used, only skipped
+        uint32_t index_size = 0;
+        char index_magic[4] = {0};
+        fseek(result->file, -4, SEEK_END);
+        fread(&index_size, 4, 1, result->file);
+        if (index_size >= 12 && index_size <= result->file_size - result->frames_offset) {
+            fseek(result->file, result->file_size - index_size, SEEK_SET);
+            fread(index_magic, 4, 1, result->file);
+            if (memcmp(index_magic, "RVFX", 4) == 0) {
+                result->frames_end = result->file_size - index_size;
+            }
+        }
+    }
+    fseek(result->file, result->frames_offset, SEEK_SET);
+    result->last_frame = 0;
+
+    result->wait_keyframe = 0;
+    result->decoded_frames = 0;
+    result->concealed_frames = 0;
+    result->bad_frames = 0;
+    result->resyncs = 0;
+    result->skipped_bytes = 0;
     return result;
 }
 
@@ -92,26 +257,150 @@ void rvf_close(RVF_File** file) {
     *file = NULL;
 }
 
+static int read_u32_at(FILE* file, long offset, uint32_t* value) {
+    fseek(file, offset, SEEK_SET);
+    return fread(value, 4, 1, file) == 1;
+}
+
+// Checks that frame at offset has known flags and its size matches the duplicate at the end.
+// Returns offset of the next frame or -1.
+static long frame_end(RVF_File* file, long offset) {
+    uint32_t size, tail;
+    uint8_t flags;
+    uint32_t min_size = file->has_checksums ? 1 + 4 + 4 : 1 + 4;
+    if (!read_u32_at(file->file, offset, &size) || size < min_size || offset + 4 + (long)size > file->frames_end) {
+        return -1;
+    }
+    if (fread(&flags, 1, 1, file->file) != 1 || flags & ~(FRAME_IS_KEYFRAME | FRAME_IS_FIRST | FRAME_IS_LAST)) {
+        return -1;
+    }
+    if (!read_u32_at(file->file, offset + size, &tail) || tail != size) {
+        return -1;
+    }
+    return offset + 4 + size;
+}
+
+// Looks for the start of a frame after broken data using duplicated frame sizes.
+// Frame must be followed by another frame or the end of file.
+static long find_frame(RVF_File* file, long from) {
+    uint8_t chunk[64 * 1024];
+    for (long start = from; start + 4 < file->frames_end; start += sizeof(chunk) - 3) {
+        fseek(file->file, start, SEEK_SET);
+        size_t count = fread(chunk, 1, sizeof(chunk), file->file);
+        for (size_t i = 0; i + 4 <= count; i++) {
+            long offset = start + i;
+            uint32_t size = chunk[i] | chunk[i + 1] << 8 | chunk[i + 2] << 16 | (uint32_t)chunk[i + 3] << 24;
+            // Quick check before reading the tail
+            if (offset + 4 + (long)size > file->frames_end) {
+                continue;
+            }
+            long next = frame_end(file, offset);
+            if (next >= 0 && (next == file->frames_end || frame_end(file, next) >= 0)) {
+                return offset;
+            }
+        }
+    }
+    return -1;
+}
+
 uint8_t* rvf_next_frame(RVF_File* file) {
     file->current_frame++;
-    if (file->current_frame >= file->length) {
+    int end;
+    if (file->length >= 0) {
+        end = file->current_frame >= file->length;
+    } else {
+        end = file->last_frame || ftell(file->file) >= file->frames_end;
+    }
+    if (end) {
         file->current_frame = 0;
+        file->last_frame = 0;
         fseek(file->file, file->frames_offset, SEEK_SET);
     }
 
     if (file->is_compressed) {
+        // Broken frame is not decoded, previous one stays on screen until the next keyframe
+        long offset = ftell(file->file);
+        long next = frame_end(file, offset);
+        if (next < 0) {
+            // Frame boundaries are lost, searching for the next frame
+            long found = find_frame(file, offset + 1);
+            if (found >= 0) {
+                file->resyncs++;
+            } else {
+                found = file->frames_end;
+            }
+            if (offset < file->frames_end) {
+                file->bad_frames++;
+                printf("Frame %d is broken, %ld bytes skipped.\n", file->current_frame, found - offset);
+            }
+            file->skipped_bytes += found - offset;
+            fseek(file->file, found, SEEK_SET);
+            file->wait_keyframe = 1;
+            file->concealed_frames++;
+            return file->data;
+        }
+
         uint32_t data_length;
         uint8_t flags;
+        fseek(file->file, offset, SEEK_SET);
         fread(&data_length, 4, 1, file->file);
         fread(&flags, 1, 1, file->file);
-        dec_decode(file->decoder, file->file, data_length - 4 - 1, file->data, debug);
-        fseek(file->file, 4, SEEK_CUR);
-    } else {
+        file->last_frame = (flags & FRAME_IS_LAST) > 0;
+        if (file->wait_keyframe && !(flags & FRAME_IS_KEYFRAME)) {
+            fseek(file->file, next, SEEK_SET);
+            file->concealed_frames++;
+            return file->data;
+        }
+
+        int broken = 0;
+        uint32_t length = data_length - 4 - 1 - (file->has_checksums ? 4 : 0);
+        uint8_t* buffer = dec_read(file->decoder, file->file, length);
+        if (file->has_checksums) {
+            uint32_t stored_crc = 0;
+            fread(&stored_crc, 4, 1, file->file);
+            if (crc32_update(crc32_update(0, &flags, 1), buffer, length) != stored_crc) {
+                printf("Frame %d checksum mismatch.\n", file->current_frame);
+                broken = 1;
+            }
+        }
+        if (!broken && dec_decode_buffer(file->decoder, file->data, debug) != 0) {
+            printf("Frame %d is broken.\n", file->current_frame);
+            broken = 1;
+        }
+        if (broken) {
+            file->bad_frames++;
+            file->concealed_frames++;
+            file->wait_keyframe = 1;
+        } else {
+            file->decoded_frames++;
+            file->wait_keyframe = 0;
+        }
+        fseek(file->file, next, SEEK_SET);
+    } else if (ftell(file->file) + file->frame_size <= file->frames_end) {
+        // Every uncompressed frame is independent
         fread(file->data, file->frame_size, 1, file->file);
+        file->decoded_frames++;
+    } else {
+        // Missing frame, previous one stays on screen
+        if (ftell(file->file) < file->frames_end) {
+            file->bad_frames++;
+            printf("Frame %d is broken.\n", file->current_frame);
+        }
+        fseek(file->file, file->frames_end, SEEK_SET);
+        file->concealed_frames++;
     }
     return file->data;
 }
 
+void rvf_print_stats(RVF_File* file) {
+    printf("Frames decoded: %d, concealed: %d (%d broken, %d resyncs, %ld bytes skipped)\n",
+           file->decoded_frames,
+           file->concealed_frames,
+           file->bad_frames,
+           file->resyncs,
+           file->skipped_bytes);
+}
+
 void rvf_debug(int enabled) {
     debug = enabled;
 }
@@ -16,7 +16,9 @@ typedef struct RVF_Color {
 typedef struct RVF_Audio {
     int channels;
     unsigned int frequency;
-    int bit_depth;
+    int bit_depth;  // of the decoded buffer
+    int codec;
+    int block_align;
     char* buffer;
     size_t buffer_size;
 } RVF_Audio;
@@ -27,10 +29,14 @@ typedef struct RVF_File {
     int width;
     int height;
     int colors;
-    int length;
+    int length;  // -1 if unknown, stream ends with the last frame flag
     // Other data
     int is_compressed;
+    int has_checksums;
     FILE* file;
+    long file_size;
+    long frames_end;  // index starts here
+    int last_frame;   // frame with the last frame flag was read
     float frame_time;
     RVF_Color* palette;
     uint8_t* data;
@@ -39,12 +45,20 @@ typedef struct RVF_File {
     int frame_size;
     Decoder* decoder;
     RVF_Audio* audio;
+    // Error concealment
+    int wait_keyframe;
+    int decoded_frames;
+    int concealed_frames;  // previous frame shown instead
+    int bad_frames;        // checksum mismatch or broken data
+    int resyncs;
+    long skipped_bytes;
 } RVF_File;
 
 RVF_File* rvf_open(const char* filename);
 void rvf_close(RVF_File** file);
 uint8_t* rvf_next_frame(RVF_File* file);
 void rvf_debug(int enabled);
+void rvf_print_stats(RVF_File* file);
 // char* rvf_prev_frame(RVF_File* file);
 //  char* rvf_seek(RVF_File* file, float seconds, int relative, int precise);
 //  char* rvf_seek(RVF_File* file, int frames, int relative, int precise);